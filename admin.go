@@ -0,0 +1,309 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// mirrorInfo describes a mirror in the admin API.
+type mirrorInfo struct {
+	Name      string     `json:"name"`
+	Remote    string     `json:"remote,omitempty"`
+	Archived  bool       `json:"archived"`
+	LastFetch *time.Time `json:"last_fetch,omitempty"`
+}
+
+func describeMirror(ctx context.Context, abspath string) mirrorInfo {
+	rv := mirrorInfo{
+		Name:     mirrorName(abspath),
+		Remote:   remoteURL(ctx, abspath),
+		Archived: loadConfig(ctx, abspath).bool("gitmirror.archived"),
+	}
+	if t := lastFetch(abspath); !t.IsZero() {
+		rv.LastFetch = &t
+	}
+	return rv
+}
+
+// mirrorPath validates the name of a mirror given to the admin API and
+// returns where it lives.  Names are slash separated paths relative to
+// -dir, and can't step outside it or collide with gitmirror's own
+// bin directory or _ paths.
+func mirrorPath(name string) (string, error) {
+	c := path.Clean("/" + name)[1:]
+	first := strings.Split(c, "/")[0]
+	switch {
+	case c == "" || c != strings.Trim(name, "/"):
+		return "", fmt.Errorf("invalid mirror name %q", name)
+	case first == "bin" || strings.HasPrefix(first, "_"):
+		return "", fmt.Errorf("reserved mirror name %q", name)
+	}
+	return filepath.Join(*thePath, filepath.FromSlash(c)), nil
+}
+
+// isMirror reports whether dir looks like a bare repository.
+func isMirror(dir string) bool {
+	return exists(filepath.Join(dir, "HEAD")) &&
+		exists(filepath.Join(dir, "objects"))
+}
+
+// listMirrors finds all the mirrors under -dir.
+func listMirrors() ([]string, error) {
+	var rv []string
+	err := filepath.Walk(*thePath, func(p string, info os.FileInfo, err error) error {
+		switch {
+		case err != nil:
+			return err
+		case !info.IsDir():
+		case p == filepath.Join(*thePath, "bin"):
+			return filepath.SkipDir
+		case p != *thePath && isMirror(p):
+			rv = append(rv, p)
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	return rv, err
+}
+
+func adminAuthorized(req *http.Request) bool {
+	got := []byte(req.Header.Get("Authorization"))
+	return *adminToken != "" && subtle.ConstantTimeCompare(
+		got, []byte("Bearer "+*adminToken)) == 1
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	maybePanic(json.NewEncoder(w).Encode(v))
+}
+
+// handleAdmin serves the mirror lifecycle API:
+//
+//	GET    /_admin/mirrors         list all mirrors
+//	POST   /_admin/mirrors         create {"name": ..., "url": ...}
+//	GET    /_admin/mirrors/{name}  describe a mirror
+//	PATCH  /_admin/mirrors/{name}  rename {"name": ...} and/or
+//	                               archive {"archived": true}
+//	DELETE /_admin/mirrors/{name}  delete a mirror
+//
+// Changes to a mirror go through the same runner as its fetches.
+func handleAdmin(w http.ResponseWriter, req *http.Request) {
+	if !adminAuthorized(req) {
+		http.Error(w, "not authorized", http.StatusUnauthorized)
+		return
+	}
+
+	name := strings.TrimPrefix(req.URL.Path, "/_admin/mirrors")
+	name = strings.TrimPrefix(name, "/")
+
+	switch {
+	case name == "" && req.Method == "GET":
+		adminList(w, req)
+	case name == "" && req.Method == "POST":
+		adminCreate(w, req)
+	case name == "":
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	default:
+		abspath, err := mirrorPath(name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !isMirror(abspath) {
+			http.Error(w, "Not found", http.StatusNotFound)
+			return
+		}
+		// Through an alias is the same as by its real name.
+		abspath = canonicalPath(abspath)
+
+		switch req.Method {
+		case "GET":
+			writeJSON(w, http.StatusOK, describeMirror(req.Context(), abspath))
+		case "PATCH":
+			adminUpdate(w, req, abspath)
+		case "DELETE":
+			adminDelete(w, req, abspath)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+func adminList(w http.ResponseWriter, req *http.Request) {
+	paths, err := listMirrors()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	rv := []mirrorInfo{}
+	for _, p := range paths {
+		rv = append(rv, describeMirror(req.Context(), p))
+	}
+	writeJSON(w, http.StatusOK, rv)
+}
+
+func adminCreate(w http.ResponseWriter, req *http.Request) {
+	var body struct {
+		Name string
+		URL  string
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		http.Error(w, "Error parsing JSON", http.StatusBadRequest)
+		return
+	}
+	if body.URL == "" {
+		http.Error(w, "url is required", http.StatusBadRequest)
+		return
+	}
+	abspath, err := mirrorPath(body.Name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := os.MkdirAll(filepath.Dir(abspath), os.ModePerm); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := os.Mkdir(abspath, os.ModePerm); err != nil {
+		if os.IsExist(err) {
+			http.Error(w, "Mirror exists", http.StatusConflict)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Creating mirror %v of %v", abspath, body.URL)
+	create := createJob(context.Background(), body.URL, nil)
+	<-queueJob(abspath, func(s *runState) {
+		create(s)
+		err = s.fetchErr
+		if err != nil {
+			os.RemoveAll(abspath)
+		}
+	})
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusCreated, describeMirror(req.Context(), abspath))
+}
+
+func adminUpdate(w http.ResponseWriter, req *http.Request, abspath string) {
+	var body struct {
+		Name     *string
+		Archived *bool
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		http.Error(w, "Error parsing JSON", http.StatusBadRequest)
+		return
+	}
+
+	dest := abspath
+	if body.Name != nil {
+		var err error
+		if dest, err = mirrorPath(*body.Name); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	// A PATCH that fails changes nothing: the move is checked before
+	// anything's done, and undone if archiving fails.  Moving a mirror
+	// to one of its own aliases (i.e. to its upstream's new name) is
+	// fine, and its other aliases follow it.
+	status, err := http.StatusOK, error(nil)
+	<-queueJob(abspath, func(s *runState) {
+		var aliases []string
+		if dest != abspath {
+			for _, a := range aliasesOf(abspath) {
+				if a != dest {
+					aliases = append(aliases, a)
+				}
+			}
+			if exists(dest) && canonicalPath(dest) != abspath {
+				status, err = http.StatusConflict, errors.New("Mirror exists")
+				return
+			}
+			// Whatever link is in the way (an alias of this mirror,
+			// or of one that's gone) is put back if the move fails.
+			link, _ := os.Readlink(dest)
+			if link != "" {
+				err = os.Remove(dest)
+			}
+			if err == nil {
+				err = os.MkdirAll(filepath.Dir(dest), os.ModePerm)
+			}
+			if err == nil {
+				err = os.Rename(abspath, dest)
+			}
+			if err != nil {
+				if link != "" {
+					os.Symlink(link, dest)
+				}
+				status = http.StatusInternalServerError
+				return
+			}
+			defer func() {
+				if err != nil {
+					os.Rename(dest, abspath)
+					if link != "" {
+						os.Symlink(link, dest)
+					}
+				}
+			}()
+		}
+		if body.Archived != nil {
+			if err = setArchived(context.Background(), dest,
+				*body.Archived); err != nil {
+				status = http.StatusInternalServerError
+				return
+			}
+		}
+		if dest != abspath {
+			log.Printf("Moved mirror %v to %v", abspath, dest)
+			moveFetches(abspath, dest)
+			if aerr := retargetAliases(aliases, dest); aerr != nil {
+				log.Printf("Error moving aliases of %v: %v", abspath, aerr)
+			}
+		}
+	})
+
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	writeJSON(w, status, describeMirror(req.Context(), dest))
+}
+
+func adminDelete(w http.ResponseWriter, req *http.Request, abspath string) {
+	var err error
+	<-queueJob(abspath, func(s *runState) {
+		log.Printf("Deleting mirror %v", abspath)
+		aliases := aliasesOf(abspath)
+		if err = os.RemoveAll(abspath); err == nil {
+			err = retargetAliases(aliases, "")
+		}
+		forgetFetches(abspath)
+	})
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
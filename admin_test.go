@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+var runnerOnce sync.Once
+
+// startRunner starts the commandRunner that queued jobs need, once.
+func startRunner() {
+	runnerOnce.Do(func() { go commandRunner() })
+}
+
+func TestMirrorPath(t *testing.T) {
+	defer func(p string) { *thePath = p }(*thePath)
+	*thePath = "/srv/mirrors"
+
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"gitmirror.git", "/srv/mirrors/gitmirror.git"},
+		{"dustin/gitmirror.git", "/srv/mirrors/dustin/gitmirror.git"},
+		{"/dustin/gitmirror.git/", "/srv/mirrors/dustin/gitmirror.git"},
+		{"", ""},
+		{"../etc", ""},
+		{"dustin/../../etc", ""},
+		{"dustin//x.git", ""},
+		{"bin/x.git", ""},
+		{"_admin", ""},
+	}
+
+	for _, test := range tests {
+		got, err := mirrorPath(test.name)
+		if got != test.want || (err == nil) != (test.want != "") {
+			t.Errorf("mirrorPath(%q) = %q, %v; want %q",
+				test.name, got, err, test.want)
+		}
+	}
+}
+
+func TestListMirrors(t *testing.T) {
+	defer func(p string) { *thePath = p }(*thePath)
+	*thePath = t.TempDir()
+
+	for _, p := range []string{"a.git", "org/b.git", "org/deeper/c.git"} {
+		if out, err := exec.Command(*git, "init", "-q", "--bare",
+			filepath.Join(*thePath, p)).CombinedOutput(); err != nil {
+			t.Fatalf("git init: %v\n%s", err, out)
+		}
+	}
+	if err := os.MkdirAll(filepath.Join(*thePath, "bin", "post-fetch.d"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := listMirrors()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		filepath.Join(*thePath, "a.git"),
+		filepath.Join(*thePath, "org/b.git"),
+		filepath.Join(*thePath, "org/deeper/c.git"),
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("listMirrors() = %v; want %v", got, want)
+	}
+}
+
+func TestAdminAPI(t *testing.T) {
+	defer func(p, tok string) { *thePath, *adminToken = p, tok }(*thePath, *adminToken)
+	*thePath = t.TempDir()
+	*adminToken = "sekrit"
+	startRunner()
+
+	src := filepath.Join(t.TempDir(), "src.git")
+	gitInit(t, src)
+
+	s := httptest.NewServer(http.HandlerFunc(handleAdmin))
+	defer s.Close()
+
+	tests := []struct {
+		method, path string
+		auth         bool
+		body         string
+		status       int
+		// What the mirror should look like afterwards, if anything.
+		want *mirrorInfo
+	}{
+		{"GET", "", false, "", http.StatusUnauthorized, nil},
+		{"POST", "", false, `{"name":"org/a.git","url":"` + src + `"}`,
+			http.StatusUnauthorized, nil},
+		{"POST", "", true, `{"name":"org/a.git","url":"` + src + `"}`,
+			http.StatusCreated, &mirrorInfo{Name: "org/a.git", Remote: src}},
+		{"POST", "", true, `{"name":"org/a.git","url":"` + src + `"}`,
+			http.StatusConflict, nil},
+		{"POST", "", true, `{"name":"../a.git","url":"` + src + `"}`,
+			http.StatusBadRequest, nil},
+		{"POST", "", true, `{"name":"b.git"}`, http.StatusBadRequest, nil},
+		{"POST", "", true, `{"name":"b.git","url":"` + src + `"}`,
+			http.StatusCreated, &mirrorInfo{Name: "b.git", Remote: src}},
+		{"PATCH", "/org/a.git", true, `{"name":"b.git","archived":true}`,
+			http.StatusConflict, nil},
+		// The failed PATCH didn't archive it either.
+		{"GET", "/org/a.git", true, "", http.StatusOK,
+			&mirrorInfo{Name: "org/a.git", Remote: src}},
+		{"PATCH", "/org/a.git", true, `{"name":"../b.git","archived":true}`,
+			http.StatusBadRequest, nil},
+		{"GET", "/org/a.git", true, "", http.StatusOK,
+			&mirrorInfo{Name: "org/a.git", Remote: src}},
+		{"PATCH", "/org/a.git", true, `{"name":"org/c.git","archived":true}`,
+			http.StatusOK, &mirrorInfo{Name: "org/c.git", Remote: src, Archived: true}},
+		{"GET", "/org/a.git", true, "", http.StatusNotFound, nil},
+		{"GET", "/org/c.git", true, "", http.StatusOK,
+			&mirrorInfo{Name: "org/c.git", Remote: src, Archived: true}},
+		{"DELETE", "/org/c.git", false, "", http.StatusUnauthorized, nil},
+		{"DELETE", "/org/c.git", true, "", http.StatusNoContent, nil},
+		{"GET", "/org/c.git", true, "", http.StatusNotFound, nil},
+	}
+
+	for _, test := range tests {
+		req, err := http.NewRequest(test.method, s.URL+"/_admin/mirrors"+test.path,
+			strings.NewReader(test.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.auth {
+			req.Header.Set("Authorization", "Bearer sekrit")
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got mirrorInfo
+		json.NewDecoder(res.Body).Decode(&got)
+		res.Body.Close()
+
+		if res.StatusCode != test.status {
+			t.Errorf("%v %v %s = %v; want %v", test.method, test.path,
+				test.body, res.Status, test.status)
+			continue
+		}
+		if test.want == nil {
+			continue
+		}
+		got.LastFetch = nil
+		if got != *test.want {
+			t.Errorf("%v %v %s = %+v; want %+v", test.method, test.path,
+				test.body, got, *test.want)
+		}
+		if !isMirror(filepath.Join(*thePath, filepath.FromSlash(got.Name))) {
+			t.Errorf("%v %v: no mirror at %v", test.method, test.path, got.Name)
+		}
+	}
+
+	for _, p := range []string{"org/a.git", "org/c.git"} {
+		if exists(filepath.Join(*thePath, p)) {
+			t.Errorf("%v is still there", p)
+		}
+	}
+}
+
+func TestAdminAliases(t *testing.T) {
+	defer func(p, tok string) { *thePath, *adminToken = p, tok }(*thePath, *adminToken)
+	*thePath = t.TempDir()
+	*adminToken = "sekrit"
+	startRunner()
+
+	at := func(p string) string { return filepath.Join(*thePath, filepath.FromSlash(p)) }
+	gitInit(t, at("dustin/old.git"))
+	os.MkdirAll(at("other"), 0755)
+	// As moveUpstream leaves them.
+	for alias, target := range map[string]string{
+		"dustin/new.git": "old.git",
+		"other/old.git":  "../dustin/old.git",
+	} {
+		if err := os.Symlink(target, at(alias)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got := aliasesOf(at("dustin/old.git"))
+	want := []string{at("dustin/new.git"), at("other/old.git")}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("aliasesOf = %v; want %v", got, want)
+	}
+
+	admin := func(method, name, body string) int {
+		req := httptest.NewRequest(method, "/_admin/mirrors/"+name,
+			strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer sekrit")
+		w := httptest.NewRecorder()
+		handleAdmin(w, req)
+		return w.Code
+	}
+	// resolvesTo checks where each of aliases leads.
+	resolvesTo := func(step, to string, aliases ...string) {
+		for _, a := range aliases {
+			if got := canonicalPath(at(a)); got != at(to) || !isMirror(at(a)) {
+				t.Errorf("after %v, %v leads to %v; want %v", step, a, got, at(to))
+			}
+		}
+	}
+
+	if code := admin("PATCH", "dustin/old.git", `{"name":"moved/x.git"}`); code != http.StatusOK {
+		t.Fatalf("move: %v", code)
+	}
+	resolvesTo("move", "moved/x.git", "dustin/new.git", "other/old.git")
+
+	// Onto one of its own aliases, i.e. its upstream's new name.
+	if code := admin("PATCH", "moved/x.git", `{"name":"dustin/new.git"}`); code != http.StatusOK {
+		t.Fatalf("move onto alias: %v", code)
+	}
+	if st, err := os.Lstat(at("dustin/new.git")); err != nil || !st.IsDir() {
+		t.Errorf("dustin/new.git isn't the mirror: %v, %v", st, err)
+	}
+	resolvesTo("move onto alias", "dustin/new.git", "other/old.git")
+
+	// Deleting through an alias deletes the mirror, and its aliases.
+	if code := admin("DELETE", "other/old.git", ""); code != http.StatusNoContent {
+		t.Fatalf("delete: %v", code)
+	}
+	for _, p := range []string{"dustin/new.git", "other/old.git", "moved/x.git"} {
+		if _, err := os.Lstat(at(p)); !os.IsNotExist(err) {
+			t.Errorf("%v left behind: %v", p, err)
+		}
+	}
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// Where repositories live when a payload doesn't say.
+const defaultHost = "github.com"
+
+// repoPayload is the part of a webhook payload describing the
+// repository.  Old style (github services) payloads only have the
+// owner's name and the repository's name; newer ones (including those
+// from github enterprise) have URLs for every protocol.
+type repoPayload struct {
+	Repository struct {
+		Owner    interface{}
+		Private  bool
+		Name     string
+		CloneURL string `json:"clone_url"`
+		SSHURL   string `json:"ssh_url"`
+		GitURL   string `json:"git_url"`
+		HTMLURL  string `json:"html_url"`
+	}
+}
+
+func (p repoPayload) ownerName() string {
+	switch i := p.Repository.Owner.(type) {
+	case string:
+		return i
+	case map[string]interface{}:
+		if x, ok := i["login"]; ok {
+			return fmt.Sprintf("%v", x)
+		}
+		return fmt.Sprintf("%v", i["name"])
+	}
+	return ""
+}
+
+// host is where the repository lives, according to whichever of its
+// URLs the payload has.
+func (p repoPayload) host() string {
+	for _, s := range []string{p.Repository.HTMLURL, p.Repository.CloneURL} {
+		if u, err := url.Parse(s); err == nil && u.Host != "" {
+			return u.Host
+		}
+	}
+	return defaultHost
+}
+
+// mapHost rewrites the host of a clone URL (including scp-like
+// user@host:path URLs) according to -hostmap.
+func mapHost(u string) string {
+	for _, m := range strings.Split(*hostMap, ",") {
+		parts := strings.SplitN(strings.TrimSpace(m), "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		from, to := parts[0], parts[1]
+
+		if pu, err := url.Parse(u); err == nil && pu.Scheme != "" {
+			if pu.Host == from || pu.Hostname() == from {
+				pu.Host = to
+				return pu.String()
+			}
+			continue
+		}
+		if at := strings.Index(u, "@"); at >= 0 &&
+			strings.HasPrefix(u[at+1:], from+":") {
+			return u[:at+1] + to + u[at+1+len(from):]
+		}
+	}
+	return u
+}
+
+// Ways of cloning a repository.
+const (
+	cloneHTTPS = "https"
+	cloneSSH   = "ssh"
+	// https, authenticating with a token (see gitEnv)
+	cloneToken = "token"
+)
+
+// A cloneRule picks the clone strategy for repositories on a host,
+// or just those of one owner on a host.  An empty host matches
+// everything.
+type cloneRule struct {
+	host, owner string
+	strategy    string
+}
+
+// parseCloneRules parses -clone, a comma separated list of
+// [host[/owner]=]strategy rules.
+func parseCloneRules(s string) ([]cloneRule, error) {
+	var rv []cloneRule
+	for _, r := range strings.Split(s, ",") {
+		r = strings.TrimSpace(r)
+		if r == "" {
+			continue
+		}
+
+		rule := cloneRule{strategy: r}
+		if i := strings.LastIndex(r, "="); i >= 0 {
+			rule.strategy = r[i+1:]
+			parts := strings.SplitN(r[:i], "/", 2)
+			rule.host = parts[0]
+			if len(parts) == 2 {
+				rule.owner = parts[1]
+			}
+		}
+
+		switch rule.strategy {
+		case cloneHTTPS, cloneSSH, cloneToken:
+		default:
+			return nil, fmt.Errorf("unknown clone strategy %q in %q",
+				rule.strategy, r)
+		}
+		rv = append(rv, rule)
+	}
+	return rv, nil
+}
+
+// cloneStrategy returns how to clone owner's repository on host.  The
+// most specific matching rule wins; without one, private repositories
+// are cloned over ssh and public ones over https.
+func cloneStrategy(rules []cloneRule, host, owner string, private bool) string {
+	best, score := "", -1
+	for _, r := range rules {
+		s := 0
+		switch {
+		case r.host == "":
+		case r.host != host:
+			continue
+		case r.owner == "":
+			s = 1
+		case r.owner == owner:
+			s = 2
+		default:
+			continue
+		}
+		if s > score {
+			best, score = r.strategy, s
+		}
+	}
+
+	switch {
+	case best != "":
+		return best
+	case private:
+		return cloneSSH
+	}
+	return cloneHTTPS
+}
+
+// cloneRules are the parsed -clone rules.
+var cloneRules []cloneRule
+
+// hostOf returns the host (without any port) a clone URL points at.
+func hostOf(u string) string {
+	if pu, err := url.Parse(u); err == nil && pu.Scheme != "" {
+		return pu.Hostname()
+	}
+	// scp-like user@host:path
+	if at := strings.Index(u, "@"); at >= 0 {
+		u = u[at+1:]
+	}
+	if i := strings.Index(u, ":"); i >= 0 {
+		return u[:i]
+	}
+	return ""
+}
+
+// ownerOf returns the owner of the repository a clone URL points at.
+func ownerOf(u string) string {
+	p := u
+	if pu, err := url.Parse(u); err == nil && pu.Scheme != "" {
+		p = pu.Path
+	} else if i := strings.Index(u, ":"); i >= 0 {
+		p = u[i+1:]
+	}
+	parts := strings.Split(strings.Trim(p, "/"), "/")
+	if len(parts) < 2 {
+		return ""
+	}
+	return parts[len(parts)-2]
+}
+
+// errBadRemote is returned for a payload whose clone URL gitmirror
+// won't clone from.
+var errBadRemote = errors.New("refusing to clone")
+
+// scp-like user@host:path, where nothing can be taken for an option.
+var scpURLRE = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9._~-]*@[A-Za-z0-9][A-Za-z0-9.-]*:[^-]`)
+
+// checkRemote makes sure a clone URL taken from a payload is one of
+// https://, ssh:// or user@host:path, and points at host (where the
+// payload says the repository lives, after -hostmap) or somewhere
+// -hostmap sends things.  Anything else (e.g. a local path) could have
+// gitmirror mirror, and then serve, something it shouldn't.
+func checkRemote(u, host string) error {
+	if pu, err := url.Parse(u); err == nil && pu.Scheme != "" {
+		if pu.Scheme != "https" && pu.Scheme != "ssh" {
+			return fmt.Errorf("%w %q: unsupported scheme", errBadRemote, u)
+		}
+		if pu.Host == "" || strings.HasPrefix(pu.Host, "-") {
+			return fmt.Errorf("%w %q: no host", errBadRemote, u)
+		}
+	} else if !scpURLRE.MatchString(u) {
+		return fmt.Errorf("%w %q: not a URL", errBadRemote, u)
+	}
+
+	h := hostOf(u)
+	if h == host {
+		return nil
+	}
+	for _, m := range strings.Split(*hostMap, ",") {
+		parts := strings.SplitN(strings.TrimSpace(m), "=", 2)
+		if len(parts) == 2 && (h == hostOf("https://"+parts[1]+"/") ||
+			h == hostOf("https://"+parts[0]+"/")) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w %q: not on %v", errBadRemote, u, host)
+}
+
+// cloneURL works out where to clone a repository from, given a github
+// webhook payload.  Rules in -clone pick the strategy by the host
+// gitmirror actually connects to (i.e. after -hostmap).
+func cloneURL(payload []byte) (string, error) {
+	p := repoPayload{}
+	err := json.Unmarshal(payload, &p)
+	if err != nil {
+		return "", err
+	}
+
+	owner, name, host := p.ownerName(), p.Repository.Name, p.host()
+
+	// Private repositories can be cloned over https too if there's an
+	// app installation to get a token from.
+	private := p.Repository.Private && (app == nil || installationID(payload) == 0)
+	strategy := cloneStrategy(cloneRules,
+		hostOf(mapHost("https://"+host+"/")), owner, private)
+
+	var repo string
+	switch {
+	case strategy == cloneSSH && p.Repository.SSHURL != "":
+		repo = p.Repository.SSHURL
+	case strategy == cloneSSH:
+		repo = fmt.Sprintf("git@%v:%v/%v.git", host, owner, name)
+	case p.Repository.CloneURL != "":
+		repo = p.Repository.CloneURL
+	default:
+		repo = fmt.Sprintf("https://%v/%v/%v.git", host, owner, name)
+	}
+	repo = mapHost(repo)
+	if err := checkRemote(repo, hostOf(mapHost("https://"+host+"/"))); err != nil {
+		return "", err
+	}
+	return repo, nil
+}
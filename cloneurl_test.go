@@ -0,0 +1,116 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+const testGHEPushHook = `{
+  "repository": {
+    "name": "tools",
+    "owner": {"login": "infra", "name": "infra"},
+    "private": false,
+    "html_url": "https://ghe.example.com/infra/tools",
+    "git_url": "git://ghe.example.com/infra/tools.git",
+    "ssh_url": "git@ghe.example.com:infra/tools.git",
+    "clone_url": "https://ghe.example.com/infra/tools.git"
+  }
+}`
+
+func TestCloneURL(t *testing.T) {
+	defer func(r []cloneRule, m string) { cloneRules, *hostMap = r, m }(cloneRules, *hostMap)
+
+	tests := []struct {
+		rules, hostMap string
+		payload        string
+		want           string
+	}{
+		{"", "", testOrgPushHook, "https://github.com/rotorbench/data.git"},
+		{"ssh", "", testOrgPushHook, "git@github.com:rotorbench/data.git"},
+		{"github.com/rotorbench=ssh", "", testOrgPushHook,
+			"git@github.com:rotorbench/data.git"},
+		{"github.com/dustin=ssh", "", testOrgPushHook,
+			"https://github.com/rotorbench/data.git"},
+		{"", "", testGHEPushHook, "https://ghe.example.com/infra/tools.git"},
+		{"ssh,ghe.example.com=token", "", testGHEPushHook,
+			"https://ghe.example.com/infra/tools.git"},
+		{"", "ghe.example.com=ghe.internal:8443", testGHEPushHook,
+			"https://ghe.internal:8443/infra/tools.git"},
+		{"ghe.internal=ssh", "ghe.example.com=ghe.internal", testGHEPushHook,
+			"git@ghe.internal:infra/tools.git"},
+		{"", "", `{"repository": {"owner": "dustin", "name": "gitmirror"}}`,
+			"https://github.com/dustin/gitmirror.git"},
+		{"", "", `{"repository": {"owner": {"name": "dustin"}, "name": "x",
+			"private": true, "html_url": "https://ghe.example.com/dustin/x"}}`,
+			"git@ghe.example.com:dustin/x.git"},
+		{"", "ghe.example.com=ghe.internal", `{"repository": {"private": true,
+			"ssh_url": "git@ghe.example.com:infra/tools.git"}}`,
+			"git@ghe.internal:infra/tools.git"},
+	}
+
+	for _, test := range tests {
+		var err error
+		if cloneRules, err = parseCloneRules(test.rules); err != nil {
+			t.Fatal(err)
+		}
+		*hostMap = test.hostMap
+
+		got, err := cloneURL([]byte(test.payload))
+		if err != nil {
+			t.Errorf("cloneURL(%s): %v", test.payload, err)
+		} else if got != test.want {
+			t.Errorf("cloneURL(%s) with -clone=%v -hostmap=%v = %q; want %q",
+				test.payload, test.rules, test.hostMap, got, test.want)
+		}
+	}
+}
+
+func TestCloneURLRejects(t *testing.T) {
+	defer func(r []cloneRule, m string) { cloneRules, *hostMap = r, m }(cloneRules, *hostMap)
+	cloneRules, *hostMap = nil, ""
+
+	for _, u := range []string{
+		"/home/x/private.git",
+		"file:///home/x/private.git",
+		"--upload-pack=touch /tmp/pwned",
+		"ext::sh -c touch% /tmp/pwned",
+		"http://github.com/dustin/gitmirror.git",
+		"git://github.com/dustin/gitmirror.git",
+		"-oProxyCommand=x@github.com:dustin/gitmirror.git",
+		"https://evil.example.com/dustin/gitmirror.git",
+		"git@evil.example.com:dustin/gitmirror.git",
+	} {
+		payload := fmt.Sprintf(`{"repository": {"owner": "dustin",
+			"name": "gitmirror", "html_url": "https://github.com/dustin/gitmirror",
+			"clone_url": %q, "ssh_url": %q}}`, u, u)
+		for _, rules := range []string{"https", "ssh"} {
+			cloneRules, _ = parseCloneRules(rules)
+			got, err := cloneURL([]byte(payload))
+			if !errors.Is(err, errBadRemote) {
+				t.Errorf("cloneURL with %q over %v = %q, %v; want %v",
+					u, rules, got, err, errBadRemote)
+			}
+		}
+	}
+}
+
+func TestParseCloneRules(t *testing.T) {
+	got, err := parseCloneRules("ssh, ghe.example.com=token,github.com/dustin=https")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []cloneRule{
+		{"", "", cloneSSH},
+		{"ghe.example.com", "", cloneToken},
+		{"github.com", "dustin", cloneHTTPS},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseCloneRules() = %v; want %v", got, want)
+	}
+
+	if _, err := parseCloneRules("github.com=git"); err == nil {
+		t.Errorf("expected an error for the git strategy")
+	}
+}
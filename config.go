@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os/exec"
+	"strings"
+)
+
+// mirrorConfig holds a mirror's gitmirror.* settings as git sees them,
+// i.e. including anything set in the gitmirror user's global git
+// config.  Section and variable names are lowercased by git;
+// subsections (e.g. hook paths) keep their case.
+type mirrorConfig map[string][]string
+
+// loadConfig reads the gitmirror settings of the repository at
+// abspath.  A repo that doesn't exist yet (or has no settings) simply
+// has an empty config.
+func loadConfig(ctx context.Context, abspath string) mirrorConfig {
+	rv := mirrorConfig{}
+	out, err := exec.CommandContext(ctx, *git, "--git-dir="+abspath,
+		"config", "-z", "--get-regexp", `^gitmirror\.`).Output()
+	if err != nil {
+		return rv
+	}
+
+	for _, ent := range bytes.Split(out, []byte{0}) {
+		if len(ent) == 0 {
+			continue
+		}
+		parts := strings.SplitN(string(ent), "\n", 2)
+		if len(parts) == 1 {
+			// A bare boolean key, e.g. "[gitmirror] archived"
+			parts = append(parts, "true")
+		}
+		rv[parts[0]] = append(rv[parts[0]], parts[1])
+	}
+	return rv
+}
+
+// get returns the last value of key, or def if it isn't set.
+func (c mirrorConfig) get(key, def string) string {
+	if vals := c[key]; len(vals) > 0 {
+		return vals[len(vals)-1]
+	}
+	return def
+}
+
+// bool reports whether key is set to something git considers true.
+func (c mirrorConfig) bool(key string) bool {
+	switch strings.ToLower(c.get(key, "false")) {
+	case "true", "yes", "on", "1":
+		return true
+	}
+	return false
+}
+
+// setArchived marks the mirror at abspath as archived (so it's no
+// longer fetched), or not.
+func setArchived(ctx context.Context, abspath string, archived bool) error {
+	args := []string{"--git-dir=" + abspath, "config"}
+	if archived {
+		args = append(args, "gitmirror.archived", "true")
+	} else {
+		args = append(args, "--unset-all", "gitmirror.archived")
+	}
+	err := exec.CommandContext(ctx, *git, args...).Run()
+	var ee *exec.ExitError
+	if !archived && errors.As(err, &ee) && ee.ExitCode() == 5 {
+		// It wasn't archived to begin with.
+		return nil
+	}
+	return err
+}
+
+// remoteURL returns where the mirror at abspath fetches from.
+func remoteURL(ctx context.Context, abspath string) string {
+	out, err := exec.CommandContext(ctx, *git, "--git-dir="+abspath,
+		"config", "remote.origin.url").Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"os/exec"
+	"testing"
+)
+
+func TestLoadConfig(t *testing.T) {
+	dir := t.TempDir()
+	for _, args := range [][]string{
+		{"init", "-q", "--bare", dir},
+		{"--git-dir=" + dir, "config", "gitmirror.hooks/post-fetch.when", "on-change"},
+		{"--git-dir=" + dir, "config", "--add", "gitmirror.push", "a"},
+		{"--git-dir=" + dir, "config", "--add", "gitmirror.push", "b c"},
+	} {
+		if out, err := exec.Command(*git, args...).CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %v\n%s", args, err, out)
+		}
+	}
+
+	conf := loadConfig(context.Background(), dir)
+	if got := conf.get("gitmirror.hooks/post-fetch.when", "x"); got != "on-change" {
+		t.Errorf("hook policy = %q; want on-change", got)
+	}
+	if got := conf["gitmirror.push"]; len(got) != 2 || got[1] != "b c" {
+		t.Errorf("push = %q; want [a, b c]", got)
+	}
+	if got := conf.get("gitmirror.missing", "def"); got != "def" {
+		t.Errorf("missing = %q; want def", got)
+	}
+
+	if got := loadConfig(context.Background(), t.TempDir()); len(got) != 0 {
+		t.Errorf("config for a non-repo = %v", got)
+	}
+}
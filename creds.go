@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// The credential helper gitmirror gives git.  It answers every "get"
+// with the token in the environment, so the token never shows up in
+// a command line or a repository's config.
+const credentialHelper = `!f() { test "$1" = get && ` +
+	`echo username=x-access-token && ` +
+	`echo "password=$GITMIRROR_CREDENTIAL"; }; f`
+
+// credentials are what gitmirror authenticates to a remote with: a
+// token for https remotes, or a private key file for ssh ones.
+type credentials struct {
+	Token  string `json:"token,omitempty"`
+	SSHKey string `json:"ssh_key,omitempty"`
+}
+
+// credentialsFile is the format of -credentials.  Repos are keyed by
+// host/owner/name, and override the credentials of their host.
+type credentialsFile struct {
+	Hosts map[string]credentials `json:"hosts"`
+	Repos map[string]credentials `json:"repos"`
+}
+
+func loadCredentials() (credentialsFile, error) {
+	rv := credentialsFile{}
+	if *credsPath == "" {
+		return rv, nil
+	}
+	b, err := ioutil.ReadFile(*credsPath)
+	if err != nil {
+		return rv, err
+	}
+	return rv, json.Unmarshal(b, &rv)
+}
+
+// repoKey is how a remote is named in the credentials file's repos.
+func repoKey(remote string) string {
+	name := strings.TrimSuffix(remote, "/")
+	name = strings.TrimSuffix(name[strings.LastIndexAny(name, "/:")+1:], ".git")
+	return hostOf(remote) + "/" + ownerOf(remote) + "/" + name
+}
+
+// credentialsFor finds the credentials to use with remote.  The
+// credentials file is read every time, so changes to it take effect
+// without a restart.  If gitmirror is running as a github app and the
+// repository belongs to installation inst, that installation's token
+// beats any token in the file.
+func credentialsFor(remote string, inst int64) credentials {
+	f, err := loadCredentials()
+	if err != nil {
+		log.Printf("Error reading %v: %v", *credsPath, err)
+	}
+
+	var rv credentials
+	if cloneStrategy(cloneRules, hostOf(remote), ownerOf(remote),
+		false) == cloneToken {
+		rv.Token = *token
+	}
+	for _, c := range []credentials{f.Hosts[hostOf(remote)], f.Repos[repoKey(remote)]} {
+		if c.Token != "" {
+			rv.Token = c.Token
+		}
+		if c.SSHKey != "" {
+			rv.SSHKey = c.SSHKey
+		}
+	}
+
+	if app != nil && inst != 0 && strings.HasPrefix(remote, "https://") {
+		t, err := app.token(inst)
+		if err != nil {
+			log.Printf("Error getting token for installation %v: %v", inst, err)
+		} else {
+			rv.Token = t
+		}
+	}
+	return rv
+}
+
+// shellQuote quotes s for sh.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// gitEnv returns what needs adding to the environment of a git
+// command talking to remote (on behalf of app installation inst, if
+// not 0).
+func gitEnv(remote string, inst int64) []string {
+	c := credentialsFor(remote, inst)
+
+	switch {
+	case strings.HasPrefix(remote, "https://") && c.Token != "":
+		return []string{
+			// An empty helper clears any configured elsewhere.
+			"GIT_CONFIG_COUNT=2",
+			"GIT_CONFIG_KEY_0=credential.helper",
+			"GIT_CONFIG_VALUE_0=",
+			"GIT_CONFIG_KEY_1=credential.helper",
+			"GIT_CONFIG_VALUE_1=" + credentialHelper,
+			"GITMIRROR_CREDENTIAL=" + c.Token,
+		}
+	case strings.HasPrefix(remote, "https://"):
+		if cloneStrategy(cloneRules, hostOf(remote), ownerOf(remote),
+			false) == cloneToken {
+			log.Printf("No token to authenticate to %v with", remote)
+		}
+	case c.SSHKey != "" && hostOf(remote) != "":
+		return []string{"GIT_SSH_COMMAND=ssh -i " + shellQuote(c.SSHKey) +
+			" -o IdentitiesOnly=yes"}
+	}
+	return nil
+}
+
+// remoteCommand returns a git command that talks to remote, with
+// whatever credentials it (or app installation inst) needs.
+func remoteCommand(ctx context.Context, remote string, inst int64,
+	args ...string) *exec.Cmd {
+
+	cmd := exec.CommandContext(ctx, *git, args...)
+	if env := gitEnv(remote, inst); env != nil {
+		cmd.Env = append(os.Environ(), env...)
+	}
+	return cmd
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestRepoKey(t *testing.T) {
+	tests := map[string]string{
+		"https://github.com/dustin/gitmirror.git":   "github.com/dustin/gitmirror",
+		"https://ghe.example.com:8443/infra/tools/": "ghe.example.com/infra/tools",
+		"git@github.com:dustin/gitmirror.git":       "github.com/dustin/gitmirror",
+	}
+	for remote, want := range tests {
+		if got := repoKey(remote); got != want {
+			t.Errorf("repoKey(%q) = %q; want %q", remote, got, want)
+		}
+	}
+}
+
+func TestGitEnv(t *testing.T) {
+	defer func(r []cloneRule, tok, p string) {
+		cloneRules, *token, *credsPath = r, tok, p
+	}(cloneRules, *token, *credsPath)
+
+	cloneRules = []cloneRule{{"ghe.example.com", "", cloneToken}}
+	*token = "global"
+	*credsPath = filepath.Join(t.TempDir(), "creds.json")
+	if err := ioutil.WriteFile(*credsPath, []byte(`{
+	  "hosts": {"github.com": {"token": "host-token"}},
+	  "repos": {
+	    "github.com/dustin/private": {"token": "repo-token"},
+	    "github.com/dustin/deploy": {"ssh_key": "/keys/deploy key"}
+	  }
+	}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		remote string
+		want   string
+	}{
+		{"https://ghe.example.com/infra/tools.git", "GITMIRROR_CREDENTIAL=global"},
+		{"https://github.com/dustin/gitmirror.git", "GITMIRROR_CREDENTIAL=host-token"},
+		{"https://github.com/dustin/private.git", "GITMIRROR_CREDENTIAL=repo-token"},
+		{"git@github.com:dustin/deploy.git",
+			"GIT_SSH_COMMAND=ssh -i '/keys/deploy key' -o IdentitiesOnly=yes"},
+		{"git@github.com:dustin/gitmirror.git", ""},
+		{"https://example.com/x/y.git", ""},
+	}
+
+	for _, test := range tests {
+		env := gitEnv(test.remote, 0)
+		got := ""
+		if len(env) > 0 {
+			got = env[len(env)-1]
+		}
+		if got != test.want {
+			t.Errorf("gitEnv(%q) = %q; want ...%q", test.remote, env, test.want)
+		}
+	}
+}
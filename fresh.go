@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// lastFetch returns when the mirror at abspath was last fetched
+// successfully.  Before gitmirror has fetched it itself, that's when
+// anything last wrote FETCH_HEAD.
+func lastFetch(abspath string) time.Time {
+	h := recentFetches(abspath)
+	for i := len(h) - 1; i >= 0; i-- {
+		if h[i].Error == "" {
+			return h[i].Start
+		}
+	}
+	if st, err := os.Stat(filepath.Join(abspath, "FETCH_HEAD")); err == nil {
+		return st.ModTime()
+	}
+	return time.Time{}
+}
+
+// fetchedSince reports whether a fetch of abspath started since t
+// succeeded.
+func fetchedSince(abspath string, t time.Time) bool {
+	for _, r := range recentFetches(abspath) {
+		if r.Error == "" && !r.Start.Before(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// ensureFresh updates the mirror at abspath if it hasn't been fetched
+// within maxAge (so always, if that's 0), waiting at most -freshtimeout
+// for that to happen.  It reports whether the mirror is fresh, i.e.
+// whether it was already, or a fetch since asking succeeded.  An
+// update that takes too long keeps going in the background.
+func ensureFresh(abspath string, maxAge time.Duration) bool {
+	if time.Since(lastFetch(abspath)) < maxAge {
+		return true
+	}
+
+	log.Printf("Refreshing stale mirror %v", abspath)
+	asked := time.Now()
+	ch := queueCommand(nil, true, abspath,
+		updateJob(context.Background(), triggerRead, nil))
+
+	select {
+	case <-ch:
+		return fetchedSince(abspath, asked)
+	case <-time.After(*freshTimeout):
+		log.Printf("Gave up waiting for %v to update", abspath)
+		return false
+	}
+}
+
+// handleFresh makes sure a mirror has been fetched recently, e.g.
+//
+//	curl http://localhost:8124/_fresh/gitmirror.git?maxage=10m
+func handleFresh(w http.ResponseWriter, req *http.Request) {
+	section := strings.TrimPrefix(getPath(req), "_fresh/")
+	abspath := filepath.Join(*thePath, section)
+	if !exists(abspath) {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	age := *maxAge
+	if s := req.URL.Query().Get("maxage"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err == nil && d < 0 {
+			err = fmt.Errorf("negative maxage %v", d)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		age = d
+	}
+
+	if !ensureFresh(abspath, age) {
+		http.Error(w, fmt.Sprintf("Not updated since %v",
+			lastFetch(abspath).Format(time.RFC3339)),
+			http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintf(w, "Fresh as of %v\n", lastFetch(abspath).Format(time.RFC3339))
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLastFetch(t *testing.T) {
+	dir := t.TempDir()
+	if got := lastFetch(dir); !got.IsZero() {
+		t.Errorf("never fetched, but lastFetch = %v", got)
+	}
+
+	fh := filepath.Join(dir, "FETCH_HEAD")
+	if err := ioutil.WriteFile(fh, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	then := time.Now().Add(-time.Hour).Truncate(time.Second)
+	if err := os.Chtimes(fh, then, then); err != nil {
+		t.Fatal(err)
+	}
+	if got := lastFetch(dir); !got.Equal(then) {
+		t.Errorf("lastFetch = %v; want FETCH_HEAD's %v", got, then)
+	}
+
+	ok := time.Now().Add(-time.Minute)
+	recordFetch(dir, fetchRecord{Start: ok})
+	recordFetch(dir, fetchRecord{Start: time.Now(), Error: "broken"})
+	if got := lastFetch(dir); !got.Equal(ok) {
+		t.Errorf("lastFetch = %v; want last success at %v", got, ok)
+	}
+}
+
+func TestHandleFresh(t *testing.T) {
+	defer func(p string, a, ft time.Duration) {
+		*thePath, *maxAge, *freshTimeout = p, a, ft
+	}(*thePath, *maxAge, *freshTimeout)
+	*thePath, *maxAge, *freshTimeout = t.TempDir(), 0, 10*time.Second
+	startRunner()
+
+	src := filepath.Join(t.TempDir(), "src.git")
+	gitInit(t, src)
+	abspath := filepath.Join(*thePath, "m.git")
+	os.Mkdir(abspath, 0755)
+	runCommands(nil, true, abspath, createJob(context.Background(), src, nil))
+	defer forgetFetches(abspath)
+
+	fresh := func(query string) int {
+		w := httptest.NewRecorder()
+		handleFresh(w, httptest.NewRequest("GET", "/_fresh/m.git"+query, nil))
+		return w.Code
+	}
+
+	// Just created, so it's fresh enough without fetching.
+	n := len(recentFetches(abspath))
+	if got := fresh("?maxage=1h"); got != http.StatusOK {
+		t.Errorf("fresh mirror: got %v", got)
+	}
+	if len(recentFetches(abspath)) != n {
+		t.Errorf("fresh mirror was fetched anyway")
+	}
+
+	// A maxage of 0 (the default) always fetches, and that's fine.
+	for _, q := range []string{"?maxage=0", ""} {
+		n := len(recentFetches(abspath))
+		if got := fresh(q); got != http.StatusOK {
+			t.Errorf("maxage %q: got %v", q, got)
+		}
+		if len(recentFetches(abspath)) != n+1 {
+			t.Errorf("maxage %q didn't fetch", q)
+		}
+	}
+
+	if got := fresh("?maxage=-1m"); got != http.StatusBadRequest {
+		t.Errorf("negative maxage: got %v", got)
+	}
+
+	// Stale, and the fetch fails.
+	if out, err := exec.Command(*git, "--git-dir="+abspath, "remote", "set-url",
+		"origin", filepath.Join(t.TempDir(), "gone.git")).CombinedOutput(); err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if got := fresh("?maxage=1ms"); got != http.StatusServiceUnavailable {
+		t.Errorf("failing fetch: got %v", got)
+	}
+
+	if ensureFresh(abspath, time.Hour) != true {
+		t.Errorf("recently fetched mirror isn't fresh")
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dustin/httputil"
+)
+
+// Installation tokens this close to expiring are replaced.
+const tokenSlack = 5 * time.Minute
+
+// githubApp mints (and caches) installation tokens for a github app.
+type githubApp struct {
+	id     string
+	key    *rsa.PrivateKey
+	api    string
+	client *http.Client
+
+	mu     sync.Mutex
+	tokens map[int64]installationToken
+}
+
+type installationToken struct {
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// app is set up from -appid and -appkey, if given.
+var app *githubApp
+
+func parsePrivateKey(b []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+	if k, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return k, nil
+	}
+	k, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	rk, ok := k.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("not an RSA key")
+	}
+	return rk, nil
+}
+
+func newGithubApp(id, keyfile, api string) (*githubApp, error) {
+	b, err := ioutil.ReadFile(keyfile)
+	if err != nil {
+		return nil, err
+	}
+	k, err := parsePrivateKey(b)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", keyfile, err)
+	}
+	return &githubApp{
+		id:     id,
+		key:    k,
+		api:    strings.TrimSuffix(api, "/"),
+		client: &http.Client{Timeout: 30 * time.Second},
+		tokens: map[int64]installationToken{},
+	}, nil
+}
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// jwt returns the app's JSON web token, which is what it uses to ask
+// for installation tokens.
+func (a *githubApp) jwt(now time.Time) (string, error) {
+	claims, err := json.Marshal(map[string]interface{}{
+		// Allow for some clock drift.
+		"iat": now.Add(-time.Minute).Unix(),
+		"exp": now.Add(9 * time.Minute).Unix(),
+		"iss": a.id,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	unsigned := b64([]byte(`{"alg":"RS256","typ":"JWT"}`)) + "." + b64(claims)
+	sum := sha256.Sum256([]byte(unsigned))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, a.key, crypto.SHA256, sum[:])
+	if err != nil {
+		return "", err
+	}
+	return unsigned + "." + b64(sig), nil
+}
+
+// token returns a token for installation inst, minting a new one if
+// there isn't one that's good for a while yet.
+func (a *githubApp) token(inst int64) (string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if t, ok := a.tokens[inst]; ok && time.Until(t.ExpiresAt) > tokenSlack {
+		return t.Token, nil
+	}
+
+	jwt, err := a.jwt(time.Now())
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequest("POST",
+		fmt.Sprintf("%v/app/installations/%v/access_tokens", a.api, inst), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+jwt)
+	req.Header.Set("Accept", "application/vnd.github+json")
+
+	res, err := a.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusCreated {
+		return "", httputil.HTTPError(res)
+	}
+
+	t := installationToken{}
+	if err := json.NewDecoder(res.Body).Decode(&t); err != nil {
+		return "", err
+	}
+	a.tokens[inst] = t
+	return t.Token, nil
+}
+
+// installationID returns the id of the app installation a webhook
+// payload was sent for, if any.
+func installationID(payload []byte) int64 {
+	p := struct {
+		Installation struct{ ID int64 }
+	}{}
+	json.Unmarshal(payload, &p)
+	return p.Installation.ID
+}
+
+// rememberInstallation records inst as the installation to fetch the
+// mirror at abspath with, for updates whose payload doesn't say.
+func rememberInstallation(ctx context.Context, abspath string, inst int64) {
+	if inst == 0 {
+		return
+	}
+	err := exec.CommandContext(ctx, *git, "--git-dir="+abspath, "config",
+		"gitmirror.installation", strconv.FormatInt(inst, 10)).Run()
+	if err != nil {
+		log.Printf("Error recording installation of %v: %v", abspath, err)
+	}
+}
+
+// installationFor returns the installation to fetch the mirror at
+// abspath with: the one named in the payload, if any, otherwise
+// whatever gitmirror.installation says.
+func installationFor(ctx context.Context, abspath string, payload []byte) int64 {
+	known, _ := strconv.ParseInt(
+		loadConfig(ctx, abspath).get("gitmirror.installation", ""), 10, 64)
+	inst := installationID(payload)
+	if inst == 0 {
+		return known
+	}
+	if inst != known {
+		rememberInstallation(ctx, abspath, inst)
+	}
+	return inst
+}
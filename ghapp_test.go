@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func testApp(t *testing.T, expiry time.Duration) (*githubApp, func() int) {
+	k, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyfile := filepath.Join(t.TempDir(), "app.pem")
+	if err := ioutil.WriteFile(keyfile, pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(k),
+	}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	minted := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "POST" || req.URL.Path != "/app/installations/42/access_tokens" {
+			http.Error(w, "Not found", http.StatusNotFound)
+			return
+		}
+		parts := strings.Split(strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer "), ".")
+		if len(parts) != 3 {
+			http.Error(w, "No JWT", http.StatusUnauthorized)
+			return
+		}
+		sig, _ := base64.RawURLEncoding.DecodeString(parts[2])
+		sum := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+		if err := rsa.VerifyPKCS1v15(&k.PublicKey, crypto.SHA256, sum[:], sig); err != nil {
+			http.Error(w, "Bad signature", http.StatusUnauthorized)
+			return
+		}
+		claims := struct{ Iss string }{}
+		b, _ := base64.RawURLEncoding.DecodeString(parts[1])
+		if err := json.Unmarshal(b, &claims); err != nil || claims.Iss != "1234" {
+			http.Error(w, "Bad claims", http.StatusUnauthorized)
+			return
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		minted++
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(installationToken{
+			Token:     fmt.Sprintf("token-%v", minted),
+			ExpiresAt: time.Now().Add(expiry),
+		})
+	}))
+	t.Cleanup(srv.Close)
+
+	a, err := newGithubApp("1234", keyfile, srv.URL+"/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a, func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return minted
+	}
+}
+
+func TestAppToken(t *testing.T) {
+	a, minted := testApp(t, time.Hour)
+
+	for i := 0; i < 3; i++ {
+		got, err := a.token(42)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != "token-1" {
+			t.Errorf("token(42) = %q; want token-1", got)
+		}
+	}
+	if n := minted(); n != 1 {
+		t.Errorf("Minted %v tokens; want 1 (cached)", n)
+	}
+
+	if _, err := a.token(7); err == nil {
+		t.Errorf("Expected error minting a token for an unknown installation")
+	}
+}
+
+func TestAppTokenExpiring(t *testing.T) {
+	// Tokens that expire within tokenSlack are never reused.
+	a, minted := testApp(t, time.Minute)
+	for i := 1; i <= 2; i++ {
+		got, err := a.token(42)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := fmt.Sprintf("token-%v", i); got != want {
+			t.Errorf("token(42) = %q; want %q", got, want)
+		}
+	}
+	if n := minted(); n != 2 {
+		t.Errorf("Minted %v tokens; want 2", n)
+	}
+}
+
+func TestAppGitEnv(t *testing.T) {
+	defer func(a *githubApp, p string) { app, *credsPath = a, p }(app, *credsPath)
+	*credsPath = ""
+	app, _ = testApp(t, time.Hour)
+
+	tests := []struct {
+		remote string
+		inst   int64
+		want   string
+	}{
+		{"https://github.com/dustin/gitmirror.git", 42, "GITMIRROR_CREDENTIAL=token-1"},
+		{"https://github.com/dustin/gitmirror.git", 0, ""},
+		{"git@github.com:dustin/gitmirror.git", 42, ""},
+	}
+	for _, test := range tests {
+		env := gitEnv(test.remote, test.inst)
+		got := ""
+		if len(env) > 0 {
+			got = env[len(env)-1]
+		}
+		if got != test.want {
+			t.Errorf("gitEnv(%q, %v) = %q; want ...%q", test.remote, test.inst, env, test.want)
+		}
+	}
+}
+
+func TestInstallationID(t *testing.T) {
+	tests := map[string]int64{
+		`{"installation": {"id": 42, "node_id": "x"}}`: 42,
+		`{"repository": {"name": "gitmirror"}}`:        0,
+		`payload=junk`:                                 0,
+	}
+	for payload, want := range tests {
+		if got := installationID([]byte(payload)); got != want {
+			t.Errorf("installationID(%q) = %v; want %v", payload, got, want)
+		}
+	}
+}
+
+func TestInstallationFor(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	if out, err := exec.Command(*git, "init", "-q", "--bare", dir).CombinedOutput(); err != nil {
+		t.Fatalf("git init: %v\n%s", err, out)
+	}
+
+	tests := []struct {
+		payload string
+		want    int64
+	}{
+		{`{}`, 0},
+		{`{"installation": {"id": 42}}`, 42},
+		// Remembered from the last payload that said.
+		{`{}`, 42},
+		{`{"installation": {"id": 7}}`, 7},
+		{``, 7},
+	}
+	for _, test := range tests {
+		if got := installationFor(ctx, dir, []byte(test.payload)); got != test.want {
+			t.Errorf("installationFor(%q) = %v; want %v", test.payload, got, test.want)
+		}
+	}
+}
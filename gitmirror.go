@@ -6,7 +6,6 @@ import (
 	"crypto/hmac"
 	"crypto/sha1"
 	"crypto/subtle"
-	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
@@ -19,16 +18,68 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strings"
+	"text/template"
 	"time"
 )
 
 var (
 	thePath = flag.String("dir", "/tmp", "working directory")
 	git     = flag.String("git", "/usr/bin/git", "path to git")
-        proto   = flag.String("proto", "git", "git protocol to use")
+	proto   = flag.String("proto", "", "Deprecated: use -clone")
 	addr    = flag.String("addr", ":8124", "binding address to listen on")
 	secret  = flag.String("secret", "",
 		"Optional secret for authenticating hooks")
+	oldSecret = flag.String("oldsecret", "",
+		"Previous -secret, still accepted while hooks are rotated")
+	hookIn = flag.String("hookinput", "payload",
+		"What post-fetch hooks read on stdin (payload or refs)")
+	hookPolicy = flag.String("hookpolicy", hookAlways,
+		"When to run post-fetch hooks by default "+
+			"(always, on-change or on-failure)")
+	hookTimeout = flag.Duration("hooktimeout", 0,
+		"Default time limit for each hook (0 for none)")
+	repoTemplate = flag.String("repotemplate", "",
+		"Template directory for new mirrors (see git clone --template)")
+	cloneFlag = flag.String("clone", "",
+		"Comma separated [host[/owner]=]strategy rules for cloning "+
+			"new mirrors (https, ssh or token)")
+	token = flag.String("token", "",
+		"Token for the token clone strategy (default $GITMIRROR_TOKEN)")
+	credsPath = flag.String("credentials", "",
+		"JSON file of per-host and per-repo tokens and ssh keys")
+	appID = flag.String("appid", "",
+		"Github app ID to fetch as, using installation tokens")
+	appKey = flag.String("appkey", "",
+		"Private key (PEM) of the -appid github app")
+	appAPI = flag.String("appapi", "https://api.github.com",
+		"API the -appid github app's installation tokens come from")
+	hostMap = flag.String("hostmap", "",
+		"Comma separated host=otherhost rewrites for clone URLs")
+	notifyURLs = flag.String("notify", "",
+		"Comma separated URLs to notify after every update")
+	notifySecret = flag.String("notifysecret", "",
+		"Optional secret for signing notifications")
+	deadLetters = flag.String("deadletters", "",
+		"File to record undeliverable notifications in")
+	gitPrefix = flag.String("gitprefix", "",
+		"Serve mirrors over smart HTTP under this path (e.g. /git/)")
+	gitAuth = flag.String("gitauth", "",
+		"Optional user:password required for smart HTTP access")
+	gitExportAll = flag.Bool("gitexportall", false,
+		"Serve all mirrors over smart HTTP, "+
+			"not just those with git-daemon-export-ok")
+	maxAge = flag.Duration("maxage", 0,
+		"Update mirrors older than this before serving them (0 to never)")
+	freshTimeout = flag.Duration("freshtimeout", 30*time.Second,
+		"Longest a read waits for a mirror to be updated")
+	adminToken = flag.String("admintoken", "",
+		"Bearer token for the /_admin/ API (disabled if empty)")
+	tmplText = flag.String("template", "",
+		"setuphooks URL template, to map organization hook deliveries to mirrors")
+	tmplPrefix = flag.String("prefix", "",
+		"Stripped from the rendered -template to get the mirror path "+
+			"(default: the template up to its first {{)")
 )
 
 type commandRequest struct {
@@ -36,10 +87,20 @@ type commandRequest struct {
 	abspath string
 	bg      bool
 	after   time.Time
-	cmds    []*exec.Cmd
+	job     func(*runState)
 	ch      chan bool
+	// Updates of a path are coalesced; any other job always runs.
+	update bool
 }
 
+// What can cause an update.
+const (
+	triggerRequest = "request"
+	triggerWebhook = "webhook"
+	triggerCreate  = "create"
+	triggerRead    = "read"
+)
+
 var reqch = make(chan commandRequest, 100)
 var updates = map[string]time.Time{}
 
@@ -56,48 +117,142 @@ func maybePanic(err error) {
 	}
 }
 
+// runState carries a job's output and what it found out while running
+// its commands.
+type runState struct {
+	abspath string
+	stdout  io.Writer
+	stderr  io.Writer
+	changes []refChange
+	// fetchErr is why the fetch failed, if it did.
+	fetchErr error
+	// vetoed is set when a pre-fetch hook refused the update.
+	vetoed bool
+	// fetched is recorded in the fetch history once the job is done.
+	fetched *fetchRecord
+	hooks   []hookResult
+	pushes  []pushResult
+	// trigger says what asked for the update (see notifyUpdate).
+	trigger string
+}
+
+func (s *runState) run(cmd *exec.Cmd) error {
+	return s.runUntil(context.Background(), cmd)
+}
+
+// runUntil is run, except that once ctx is done, cmd is killed along
+// with everything it started.  (exec.CommandContext only kills cmd
+// itself, and a child left holding its output keeps Wait from
+// returning.)
+func (s *runState) runUntil(ctx context.Context, cmd *exec.Cmd) error {
+	if !exists(cmd.Path) {
+		return nil
+	}
+
+	log.Printf("Running %v in %v", cmd.Args, s.abspath)
+	fmt.Fprintf(s.stdout, "# Running %v\n", cmd.Args)
+	fmt.Fprintf(s.stderr, "# Running %v\n", cmd.Args)
+
+	cmd.Stdout = s.stdout
+	if cmd.Stderr == nil {
+		cmd.Stderr = s.stderr
+	}
+	cmd.Dir = s.abspath
+	err := runGroup(ctx, cmd)
+
+	if err != nil {
+		log.Printf("Error running %v in %v:  %v",
+			cmd.Args, s.abspath, err)
+		fmt.Fprintf(s.stderr,
+			"\n[gitmirror internal error:  %v]\n", err)
+	}
+	return err
+}
+
+// fetch runs a fetching command (remote update, clone), recording
+// which refs it changed.
+func (s *runState) fetch(ctx context.Context, cmd *exec.Cmd) error {
+	before, err := snapshotRefs(ctx, s.abspath)
+	if err != nil {
+		// Nothing there yet (e.g. before a clone).
+		before = map[string]string{}
+	}
+
+	start := time.Now()
+	err = s.run(cmd)
+	rec := fetchRecord{Start: start, Duration: time.Since(start),
+		Error: errString(err)}
+
+	after, serr := snapshotRefs(ctx, s.abspath)
+	if serr != nil {
+		log.Printf("Error listing refs in %v: %v", s.abspath, serr)
+	} else {
+		s.changes = diffRefs(before, after, func(o, n string) bool {
+			return isAncestor(ctx, s.abspath, o, n)
+		})
+		rec.Changes = s.changes
+	}
+
+	s.fetched = &rec
+	s.fetchErr = err
+	return err
+}
+
+// hookInput is what a post-fetch hook reads on stdin.
+func (s *runState) hookInput(payload []byte) io.Reader {
+	if *hookIn == "refs" {
+		b := &bytes.Buffer{}
+		writeRefLines(b, s.changes)
+		return b
+	}
+	return bytes.NewReader(payload)
+}
+
 func runCommands(w http.ResponseWriter, bg bool,
-	abspath string, cmds []*exec.Cmd) {
+	abspath string, job func(*runState)) {
 
-	stderr := ioutil.Discard
-	stdout := ioutil.Discard
+	s := &runState{
+		abspath: abspath,
+		stdout:  ioutil.Discard,
+		stderr:  ioutil.Discard,
+	}
 
 	if !bg {
-		stderr = &bytes.Buffer{}
-		stdout = &bytes.Buffer{}
-	}
-
-	for _, cmd := range cmds {
-		if exists(cmd.Path) {
-			log.Printf("Running %v in %v", cmd.Args, abspath)
-			fmt.Fprintf(stdout, "# Running %v\n", cmd.Args)
-			fmt.Fprintf(stderr, "# Running %v\n", cmd.Args)
-
-			cmd.Stdout = stdout
-			cmd.Stderr = stderr
-			cmd.Dir = abspath
-			err := cmd.Run()
-
-			if err != nil {
-				log.Printf("Error running %v in %v:  %v",
-					cmd.Args, abspath, err)
-				if !bg {
-					fmt.Fprintf(stderr,
-						"\n[gitmirror internal error:  %v]\n", err)
-				}
-			}
+		s.stderr = &bytes.Buffer{}
+		s.stdout = &bytes.Buffer{}
+	}
 
-		}
+	start := time.Now()
+	job(s)
+
+	if s.fetched != nil {
+		s.fetched.Hooks = s.hooks
+		s.fetched.Pushes = s.pushes
+		recordFetch(abspath, *s.fetched)
+		notifyUpdate(s, start)
 	}
 
 	if !bg {
 		fmt.Fprintf(w, "---- stdout ----\n")
-		_, err := stdout.(*bytes.Buffer).WriteTo(w)
+		_, err := s.stdout.(*bytes.Buffer).WriteTo(w)
 		maybePanic(err)
 		fmt.Fprintf(w, "\n----\n\n\n---- stderr ----\n")
-		_, err = stderr.(*bytes.Buffer).WriteTo(w)
+		_, err = s.stderr.(*bytes.Buffer).WriteTo(w)
 		maybePanic(err)
-		fmt.Fprintf(w, "\n----\n")
+		fmt.Fprintf(w, "\n----\n\n\n---- changes ----\n")
+		for _, c := range s.changes {
+			fmt.Fprintf(w, "%v %v %v %v\n",
+				c.Type, orZero(c.Old), orZero(c.New), c.Ref)
+		}
+		fmt.Fprintf(w, "----\n\n\n---- hooks ----\n")
+		for _, h := range s.hooks {
+			fmt.Fprintf(w, "%v\n", h)
+		}
+		fmt.Fprintf(w, "----\n\n\n---- pushes ----\n")
+		for _, p := range s.pushes {
+			fmt.Fprintf(w, "%v\n", p)
+		}
+		fmt.Fprintf(w, "----\n")
 	}
 }
 
@@ -115,10 +270,12 @@ func didRun(path string, t time.Time) {
 
 func pathRunner(ch chan commandRequest) {
 	for r := range ch {
-		if shouldRun(r.abspath, r.after) {
+		if !r.update || shouldRun(r.abspath, r.after) {
 			t := time.Now()
-			runCommands(r.w, r.bg, r.abspath, r.cmds)
-			didRun(r.abspath, t)
+			runCommands(r.w, r.bg, r.abspath, r.job)
+			if r.update {
+				didRun(r.abspath, t)
+			}
 		} else {
 			log.Printf("Skipping redundant update: %v", r.abspath)
 			if !r.bg {
@@ -147,14 +304,27 @@ func commandRunner() {
 }
 
 func queueCommand(w http.ResponseWriter, bg bool,
-	abspath string, cmds []*exec.Cmd) chan bool {
+	abspath string, job func(*runState)) chan bool {
+	abspath = canonicalPath(abspath)
 	req := commandRequest{w, abspath, bg, time.Now(),
-		cmds, make(chan bool)}
+		job, make(chan bool, 1), true}
+	reqch <- req
+	return req.ch
+}
+
+// queueJob runs job in the background in turn with everything else
+// happening to abspath (by whatever name), returning a channel that's
+// written to once it's done.
+func queueJob(abspath string, job func(*runState)) chan bool {
+	abspath = canonicalPath(abspath)
+	req := commandRequest{nil, abspath, true, time.Now(),
+		job, make(chan bool, 1), false}
 	reqch <- req
 	return req.ch
 }
 
-func updateGit(ctx context.Context, w http.ResponseWriter, section string, bg bool, payload []byte) bool {
+func updateGit(ctx context.Context, w http.ResponseWriter, section string,
+	trigger string, bg bool, payload []byte) bool {
 
 	abspath := filepath.Join(*thePath, section)
 
@@ -165,17 +335,32 @@ func updateGit(ctx context.Context, w http.ResponseWriter, section string, bg bo
 		return false
 	}
 
-	cmds := []*exec.Cmd{
-		exec.CommandContext(ctx, *git, "remote", "update", "-p"),
-		exec.CommandContext(ctx, *git, "gc", "--auto"),
-		exec.CommandContext(ctx, filepath.Join(abspath, "hooks/post-fetch")),
-		exec.CommandContext(ctx, filepath.Join(*thePath, "bin/post-fetch")),
-	}
+	return <-queueCommand(w, bg, abspath, updateJob(ctx, trigger, payload))
+}
 
-	cmds[2].Stdin = bytes.NewBuffer(payload)
-	cmds[3].Stdin = bytes.NewBuffer(payload)
+// updateJob returns the job that updates an existing mirror.
+func updateJob(ctx context.Context, trigger string,
+	payload []byte) func(*runState) {
 
-	return <-queueCommand(w, bg, abspath, cmds)
+	return func(s *runState) {
+		s.trigger = trigger
+		if loadConfig(ctx, s.abspath).bool("gitmirror.archived") {
+			log.Printf("Not updating archived mirror %v", s.abspath)
+			fmt.Fprintf(s.stderr, "\n[mirror is archived, not updating]\n")
+			return
+		}
+		if runPreFetch(ctx, s, payload) != nil {
+			return
+		}
+		err := s.fetch(ctx, remoteCommand(ctx, remoteURL(ctx, s.abspath),
+			installationFor(ctx, s.abspath, payload),
+			"remote", "update", "-p"))
+		s.run(exec.CommandContext(ctx, *git, "gc", "--auto"))
+		if err == nil {
+			runPushes(ctx, s)
+		}
+		runPostFetch(ctx, s, payload)
+	}
 }
 
 func getPath(req *http.Request) string {
@@ -188,66 +373,69 @@ func getPath(req *http.Request) string {
 func createRepo(ctx context.Context, w http.ResponseWriter, section string,
 	bg bool, payload []byte) {
 
-	p := struct {
-		Repository struct {
-			Owner   interface{}
-			Private bool
-			Name    string
-		}
-	}{}
-
-	err := json.Unmarshal(payload, &p)
+	repo, err := cloneURL(payload)
+	if errors.Is(err, errBadRemote) {
+		log.Printf("Not creating %v: %v", section, err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 	if err != nil {
 		log.Printf("Error unmarshalling data: %v", err)
 		http.Error(w, "Error parsing JSON", http.StatusInternalServerError)
 		return
 	}
 
-	var ownerName string
-	switch i := p.Repository.Owner.(type) {
-	case string:
-		ownerName = i
-	case map[string]interface{}:
-		if x, ok := i["login"]; ok {
-			ownerName = fmt.Sprintf("%v", x)
-		} else {
-			ownerName = fmt.Sprintf("%v", i["name"])
-		}
-	}
-
-	repo := fmt.Sprintf("%v://github.com/%v/%v.git",
-		*proto, ownerName, p.Repository.Name)
-	if p.Repository.Private {
-		repo = fmt.Sprintf("git@github.com:%v/%v.git",
-			ownerName, p.Repository.Name)
-	}
-
 	if bg {
 		ctx = context.Background()
 		w.WriteHeader(201)
 	}
 	abspath := filepath.Join(*thePath, section)
+	// An alias of a mirror that's since gone is no use to anyone.
+	if _, err := os.Lstat(abspath); err == nil && !exists(abspath) {
+		os.Remove(abspath)
+	}
 	os.Mkdir(abspath, os.ModePerm)
-	cmds := []*exec.Cmd{
-		exec.CommandContext(ctx, *git, "clone", "--mirror", "--bare", repo, abspath),
-		exec.Command(filepath.Join(abspath, "hooks/post-fetch")),
-		exec.Command(filepath.Join(*thePath, "bin/post-fetch")),
+	queueCommand(w, true, abspath, createJob(ctx, repo, payload))
+}
+
+// createJob returns the job that clones repo into a new (empty) mirror
+// directory.
+func createJob(ctx context.Context, repo string,
+	payload []byte) func(*runState) {
+
+	return func(s *runState) {
+		s.trigger = triggerCreate
+		if runPreFetch(ctx, s, payload) != nil {
+			// Leave nothing behind so the next push tries again.
+			os.Remove(s.abspath)
+			return
+		}
+		args := []string{"clone", "--mirror", "--bare"}
+		if *repoTemplate != "" {
+			args = append(args, "--template="+*repoTemplate)
+		}
+		args = append(args, "--", repo, s.abspath)
+		inst := installationID(payload)
+		if s.fetch(ctx, remoteCommand(ctx, repo, inst, args...)) == nil {
+			rememberInstallation(ctx, s.abspath, inst)
+			runPostCreate(context.Background(), s, payload)
+		}
+		runPostFetch(context.Background(), s, payload)
 	}
-	queueCommand(w, true, abspath, cmds)
 }
 
 func doUpdate(ctx context.Context, w http.ResponseWriter, path string,
-	bg bool, payload []byte) {
+	trigger string, bg bool, payload []byte) {
 	if bg {
-		go updateGit(context.Background(), w, path, bg, payload)
+		go updateGit(context.Background(), w, path, trigger, bg, payload)
 		w.WriteHeader(201)
 	} else {
-		updateGit(ctx, w, path, bg, payload)
+		updateGit(ctx, w, path, trigger, bg, payload)
 	}
 }
 
 func handleGet(w http.ResponseWriter, req *http.Request, bg bool) {
-	doUpdate(req.Context(), w, getPath(req), bg, nil)
+	doUpdate(req.Context(), w, getPath(req), triggerRequest, bg, nil)
 }
 
 // parseForm parses an HTTP POST form from an io.Reader.
@@ -271,12 +459,33 @@ func checkHMAC(h hash.Hash, sig string) bool {
 		[]byte(got), []byte(sig)) == 1
 }
 
+// checkHMACs reports whether any of macs gives sig.
+func checkHMACs(macs []hash.Hash, sig string) bool {
+	ok := false
+	for _, h := range macs {
+		// Check them all, so the time taken doesn't say which matched.
+		if checkHMAC(h, sig) {
+			ok = true
+		}
+	}
+	return ok
+}
+
 func handlePost(w http.ResponseWriter, req *http.Request, bg bool) {
 	// We're teeing the form parsing into a sha1 HMAC so we can
 	// authenticate what we actually parsed (if we *secret is set,
-	// anyway)
-	mac := hmac.New(sha1.New, []byte(*secret))
-	r := io.TeeReader(req.Body, mac)
+	// anyway).  While secrets are being rotated, either the new or
+	// the old one will do.
+	var macs []hash.Hash
+	var ws []io.Writer
+	for _, s := range []string{*secret, *oldSecret} {
+		if s != "" {
+			mac := hmac.New(sha1.New, []byte(s))
+			macs = append(macs, mac)
+			ws = append(ws, mac)
+		}
+	}
+	r := io.TeeReader(req.Body, io.MultiWriter(ws...))
 	form, err := parseForm(r)
 	if err != nil {
 		http.Error(w, err.Error(), 500)
@@ -284,15 +493,33 @@ func handlePost(w http.ResponseWriter, req *http.Request, bg bool) {
 	}
 	b := []byte(form.Get("payload"))
 
-	if !(*secret == "" || checkHMAC(mac, req.Header.Get("X-Hub-Signature"))) {
+	if !(len(macs) == 0 || checkHMACs(macs, req.Header.Get("X-Hub-Signature"))) {
 		http.Error(w, "not authorized", http.StatusUnauthorized)
 		return
 	}
 
 	path := getPath(req)
+	event := req.Header.Get("X-GitHub-Event")
+
+	if isOrgDelivery(path) {
+		if event == "ping" {
+			fmt.Fprintln(w, "pong")
+			return
+		}
+		if path, err = templatePath(b, event == "repository"); err != nil {
+			log.Printf("Can't map delivery to a mirror: %v", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if event == "repository" {
+		handleRepositoryEvent(w, path, b)
+		return
+	}
 
 	if exists(filepath.Join(*thePath, path)) {
-		doUpdate(req.Context(), w, path, bg, b)
+		doUpdate(req.Context(), w, path, triggerWebhook, bg, b)
 	} else {
 		createRepo(req.Context(), w, path, bg, b)
 	}
@@ -317,11 +544,56 @@ func handleReq(w http.ResponseWriter, req *http.Request) {
 func main() {
 	flag.Parse()
 
+	// Not the flag's default, so -h doesn't show it.
+	if *token == "" {
+		*token = os.Getenv("GITMIRROR_TOKEN")
+	}
+
+	if !validHookPolicy(*hookPolicy) {
+		log.Fatalf("Invalid -hookpolicy: %q", *hookPolicy)
+	}
+
+	switch *proto {
+	case "":
+	case cloneHTTPS, cloneSSH:
+		log.Printf("-proto is deprecated, use -clone=%v", *proto)
+		if *cloneFlag == "" {
+			*cloneFlag = *proto
+		}
+	default:
+		log.Printf("-proto=%v is no longer supported, use -clone", *proto)
+	}
+	var err error
+	if cloneRules, err = parseCloneRules(*cloneFlag); err != nil {
+		log.Fatalf("Invalid -clone: %v", err)
+	}
+	if *tmplText != "" {
+		if hookTemplate, err = template.New("u").Parse(*tmplText); err != nil {
+			log.Fatalf("Invalid -template: %v", err)
+		}
+	}
+	if *appID != "" {
+		if app, err = newGithubApp(*appID, *appKey, *appAPI); err != nil {
+			log.Fatalf("Error setting up github app: %v", err)
+		}
+	}
+
 	log.SetFlags(log.Lmicroseconds)
 
 	go commandRunner()
 
 	http.HandleFunc("/", handleReq)
+	http.HandleFunc("/_history/", handleHistory)
+	http.HandleFunc("/_fresh/", handleFresh)
+	if *adminToken != "" {
+		http.HandleFunc("/_admin/mirrors", handleAdmin)
+		http.HandleFunc("/_admin/mirrors/", handleAdmin)
+	}
+	if *gitPrefix != "" {
+		p := "/" + strings.Trim(*gitPrefix, "/") + "/"
+		*gitPrefix = p
+		http.HandleFunc(p, handleGitHTTP)
+	}
 	http.HandleFunc("/favicon.ico",
 		func(w http.ResponseWriter, req *http.Request) {
 			http.Error(w, "No favicon", http.StatusGone)
@@ -4,7 +4,12 @@ import (
 	"crypto/hmac"
 	"crypto/sha1"
 	"errors"
+	"fmt"
 	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
 	"testing"
 )
 
@@ -29,6 +34,44 @@ func TestHMACCompare(t *testing.T) {
 	}
 }
 
+func TestRotatingSecrets(t *testing.T) {
+	defer func(s, o, p string) {
+		*secret, *oldSecret, *thePath = s, o, p
+	}(*secret, *oldSecret, *thePath)
+	*thePath = t.TempDir()
+
+	body := url.Values{"payload": {`{"action": "edited"}`}}.Encode()
+	sig := func(key string) string {
+		h := hmac.New(sha1.New, []byte(key))
+		io.WriteString(h, body)
+		return fmt.Sprintf("sha1=%x", h.Sum(nil))
+	}
+
+	tests := []struct {
+		secret, old, key string
+		want             int
+	}{
+		{"", "", "whatever", http.StatusNotFound},
+		{"new", "", "new", http.StatusNotFound},
+		{"new", "", "old", http.StatusUnauthorized},
+		{"new", "old", "new", http.StatusNotFound},
+		{"new", "old", "old", http.StatusNotFound},
+		{"new", "old", "other", http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		*secret, *oldSecret = test.secret, test.old
+		req := httptest.NewRequest("POST", "/nope.git", strings.NewReader(body))
+		req.Header.Set("X-GitHub-Event", "repository")
+		req.Header.Set("X-Hub-Signature", sig(test.key))
+		w := httptest.NewRecorder()
+		handlePost(w, req, false)
+		if w.Code != test.want {
+			t.Errorf("-secret=%q -oldsecret=%q signed with %q: got %v; want %v",
+				test.secret, test.old, test.key, w.Code, test.want)
+		}
+	}
+}
+
 const testOrgPushHook = `{
   "zen": "Encourage flow.",
   "hook_id": 5564070,
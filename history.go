@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How many fetches to remember per mirror.
+const maxHistory = 20
+
+// A fetchRecord describes one fetch of a mirror.
+type fetchRecord struct {
+	Start    time.Time     `json:"start"`
+	Duration time.Duration `json:"duration"`
+	Error    string        `json:"error,omitempty"`
+	Changes  []refChange   `json:"changes,omitempty"`
+	Hooks    []hookResult  `json:"hooks,omitempty"`
+	Pushes   []pushResult  `json:"pushes,omitempty"`
+}
+
+var (
+	historyMu    sync.Mutex
+	fetchHistory = map[string][]fetchRecord{}
+)
+
+func recordFetch(abspath string, r fetchRecord) {
+	historyMu.Lock()
+	defer historyMu.Unlock()
+
+	h := append(fetchHistory[abspath], r)
+	if len(h) > maxHistory {
+		h = h[len(h)-maxHistory:]
+	}
+	fetchHistory[abspath] = h
+}
+
+// recentFetches returns the remembered fetches of a mirror, oldest
+// first.
+func recentFetches(abspath string) []fetchRecord {
+	historyMu.Lock()
+	defer historyMu.Unlock()
+	return append([]fetchRecord(nil), fetchHistory[canonicalPath(abspath)]...)
+}
+
+// moveFetches carries a mirror's history over to where it's been moved.
+func moveFetches(from, to string) {
+	historyMu.Lock()
+	defer historyMu.Unlock()
+	if h, ok := fetchHistory[from]; ok {
+		fetchHistory[to] = h
+		delete(fetchHistory, from)
+	}
+}
+
+// forgetFetches drops the history of a deleted mirror.
+func forgetFetches(abspath string) {
+	historyMu.Lock()
+	defer historyMu.Unlock()
+	delete(fetchHistory, abspath)
+}
+
+func errString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+func handleHistory(w http.ResponseWriter, req *http.Request) {
+	section := strings.TrimPrefix(getPath(req), "_history/")
+	abspath := filepath.Join(*thePath, section)
+	if !exists(abspath) {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	maybePanic(json.NewEncoder(w).Encode(recentFetches(abspath)))
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// When a hook should run, relative to the fetch before it.
+const (
+	hookAlways    = "always"
+	hookOnChange  = "on-change"
+	hookOnFailure = "on-failure"
+)
+
+// What to do with the remaining hooks when one fails.
+const (
+	hookContinue = "continue"
+	hookStop     = "stop"
+)
+
+func validHookPolicy(p string) bool {
+	switch p {
+	case hookAlways, hookOnChange, hookOnFailure:
+		return true
+	}
+	return false
+}
+
+// shouldRunHook reports whether a hook with the given policy should
+// run after a fetch that changed refs (or not) and failed (or not).
+func shouldRunHook(policy string, changed, failed bool) bool {
+	switch policy {
+	case hookOnChange:
+		return changed
+	case hookOnFailure:
+		return failed
+	}
+	return true
+}
+
+// A hook is an executable gitmirror runs at some point of an update.
+// Its name is its path relative to the mirror (for repo hooks) or to
+// -dir (for global hooks), and names its settings in git config,
+// e.g. gitmirror.hooks/post-fetch.when.
+type hook struct {
+	name string
+	path string
+}
+
+// hookResult is the outcome of a single hook.
+type hookResult struct {
+	Hook     string        `json:"hook"`
+	Duration time.Duration `json:"duration,omitempty"`
+	Error    string        `json:"error,omitempty"`
+	// Message is the last line the hook wrote to stderr.
+	Message string `json:"message,omitempty"`
+	Skipped string `json:"skipped,omitempty"`
+}
+
+func (r hookResult) String() string {
+	switch {
+	case r.Skipped != "":
+		return fmt.Sprintf("%v: skipped (%v)", r.Hook, r.Skipped)
+	case r.Error != "" && r.Message != "":
+		return fmt.Sprintf("%v: %v after %v (%v)",
+			r.Hook, r.Error, r.Duration, r.Message)
+	case r.Error != "":
+		return fmt.Sprintf("%v: %v after %v", r.Hook, r.Error, r.Duration)
+	}
+	return fmt.Sprintf("%v: ok after %v", r.Hook, r.Duration)
+}
+
+// Same rule run-parts uses, so editor backups and package manager
+// leftovers (foo~, foo.dpkg-old) are ignored.
+var hookNameRE = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// hookDir lists the executables in dir in lexical order, like
+// run-parts.
+func hookDir(name, dir string) []hook {
+	ents, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Error reading hook directory %v: %v", dir, err)
+		}
+		return nil
+	}
+
+	var rv []hook
+	for _, e := range ents {
+		if !hookNameRE.MatchString(e.Name()) {
+			continue
+		}
+		p := filepath.Join(dir, e.Name())
+		st, err := os.Stat(p)
+		if err != nil || !st.Mode().IsRegular() || st.Mode()&0111 == 0 {
+			continue
+		}
+		rv = append(rv, hook{name + "/" + e.Name(), p})
+	}
+	return rv
+}
+
+// hooksFor returns the hooks called name for the mirror at abspath in
+// the order they run: the repo's hook, the repo's name.d directory,
+// the global hook, then the global name.d directory.
+func hooksFor(abspath, name string) []hook {
+	var rv []hook
+	for _, d := range []struct{ prefix, dir string }{
+		{"hooks", filepath.Join(abspath, "hooks")},
+		{"bin", filepath.Join(*thePath, "bin")},
+	} {
+		h := hook{d.prefix + "/" + name, filepath.Join(d.dir, name)}
+		if exists(h.path) {
+			rv = append(rv, h)
+		}
+		rv = append(rv, hookDir(h.name+".d", h.path+".d")...)
+	}
+	return rv
+}
+
+// runHooks runs hooks in order, each with its own time limit, giving
+// each what stdin returns.  A failing hook whose onerror policy is
+// "stop" keeps the rest from running, and its error is returned.
+func runHooks(ctx context.Context, s *runState, conf mirrorConfig,
+	hooks []hook, onerror string, stdin func() io.Reader) error {
+
+	for i, h := range hooks {
+		timeout := *hookTimeout
+		if t := conf.get("gitmirror."+h.name+".timeout", ""); t != "" {
+			d, err := time.ParseDuration(t)
+			if err != nil {
+				log.Printf("Invalid timeout %q for %v in %v: %v",
+					t, h.name, s.abspath, err)
+			} else {
+				timeout = d
+			}
+		}
+
+		hctx, cancel := ctx, context.CancelFunc(func() {})
+		if timeout > 0 {
+			hctx, cancel = context.WithTimeout(ctx, timeout)
+		}
+		// Keep the hook's own stderr around so we can say why it
+		// failed.
+		errbuf := &bytes.Buffer{}
+		cmd := exec.Command(h.path)
+		cmd.Stdin = stdin()
+		cmd.Stderr = io.MultiWriter(s.stderr, errbuf)
+
+		start := time.Now()
+		err := s.runUntil(hctx, cmd)
+		cancel()
+
+		res := hookResult{Hook: h.name, Duration: time.Since(start),
+			Error: errString(err), Message: lastLine(errbuf.String())}
+		s.hooks = append(s.hooks, res)
+
+		if err != nil &&
+			conf.get("gitmirror."+h.name+".onerror", onerror) == hookStop {
+			for _, rest := range hooks[i+1:] {
+				s.hooks = append(s.hooks, hookResult{Hook: rest.name,
+					Skipped: h.name + " failed"})
+			}
+			if res.Message != "" {
+				return fmt.Errorf("%v: %v (%v)", h.name, err, res.Message)
+			}
+			return fmt.Errorf("%v: %v", h.name, err)
+		}
+	}
+	return nil
+}
+
+// lastLine returns the last non-blank line of s.
+func lastLine(s string) string {
+	lines := strings.Split(strings.TrimSpace(s), "\n")
+	return strings.TrimSpace(lines[len(lines)-1])
+}
+
+// runPreFetch runs the pre-fetch hooks with the payload on stdin.  If
+// one of them fails, the update must not go ahead; the returned error
+// says which hook refused it, and is recorded as the fetch's outcome.
+func runPreFetch(ctx context.Context, s *runState, payload []byte) error {
+	conf := loadConfig(ctx, s.abspath)
+	err := runHooks(ctx, s, conf, hooksFor(s.abspath, "pre-fetch"),
+		hookStop, func() io.Reader { return bytes.NewReader(payload) })
+	if err != nil {
+		err = fmt.Errorf("vetoed by %v", err)
+		log.Printf("Not updating %v: %v", s.abspath, err)
+		fmt.Fprintf(s.stderr, "\n[update aborted:  %v]\n", err)
+		s.fetched = &fetchRecord{Start: time.Now(), Error: err.Error()}
+		s.fetchErr = err
+		s.vetoed = true
+	}
+	return err
+}
+
+// runPostCreate runs the post-create hooks of a freshly cloned mirror
+// with the payload that created it on stdin.  A repo post-create hook
+// can only come from the -repotemplate directory.
+func runPostCreate(ctx context.Context, s *runState, payload []byte) {
+	conf := loadConfig(ctx, s.abspath)
+	runHooks(ctx, s, conf, hooksFor(s.abspath, "post-create"),
+		hookContinue, func() io.Reader { return bytes.NewReader(payload) })
+}
+
+// runPostFetch runs the post-fetch hooks whose policy says they care
+// about how the fetch went.
+func runPostFetch(ctx context.Context, s *runState, payload []byte) {
+	conf := loadConfig(ctx, s.abspath)
+	changed, failed := len(s.changes) > 0, s.fetchErr != nil
+
+	var hooks []hook
+	for _, h := range hooksFor(s.abspath, "post-fetch") {
+		policy := conf.get("gitmirror."+h.name+".when", *hookPolicy)
+		if !validHookPolicy(policy) {
+			log.Printf("Invalid policy %q for %v in %v, running it anyway",
+				policy, h.name, s.abspath)
+		}
+		if !shouldRunHook(policy, changed, failed) {
+			s.hooks = append(s.hooks, hookResult{Hook: h.name,
+				Skipped: policy})
+			continue
+		}
+		hooks = append(hooks, h)
+	}
+
+	runHooks(ctx, s, conf, hooks, hookContinue, func() io.Reader {
+		return s.hookInput(payload)
+	})
+}
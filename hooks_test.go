@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestShouldRunHook(t *testing.T) {
+	tests := []struct {
+		policy          string
+		changed, failed bool
+		want            bool
+	}{
+		{hookAlways, false, false, true},
+		{hookAlways, true, true, true},
+		{hookOnChange, false, false, false},
+		{hookOnChange, true, false, true},
+		{hookOnChange, false, true, false},
+		{hookOnFailure, true, false, false},
+		{hookOnFailure, false, true, true},
+		{"bogus", false, false, true},
+	}
+
+	for _, test := range tests {
+		got := shouldRunHook(test.policy, test.changed, test.failed)
+		if got != test.want {
+			t.Errorf("shouldRunHook(%q, %v, %v) = %v; want %v",
+				test.policy, test.changed, test.failed, got, test.want)
+		}
+	}
+}
+
+func TestHookDir(t *testing.T) {
+	dir := t.TempDir()
+	for name, mode := range map[string]os.FileMode{
+		"20-docs":     0755,
+		"10-ci":       0755,
+		"30-notexec":  0644,
+		"40-backup~":  0755,
+		"50.dpkg-old": 0755,
+		"60_last-one": 0755,
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name),
+			[]byte("#!/bin/sh\n"), mode); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(dir, "70-dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, h := range hookDir("hooks/post-fetch.d", dir) {
+		got = append(got, h.name)
+	}
+	want := []string{
+		"hooks/post-fetch.d/10-ci",
+		"hooks/post-fetch.d/20-docs",
+		"hooks/post-fetch.d/60_last-one",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("hookDir() = %v; want %v", got, want)
+	}
+
+	if got := hookDir("x", filepath.Join(dir, "missing")); got != nil {
+		t.Errorf("hookDir(missing) = %v", got)
+	}
+}
+
+func TestRunHooksStop(t *testing.T) {
+	dir := t.TempDir()
+	var hooks []hook
+	for _, h := range []struct{ name, body string }{
+		{"10-ok", "exit 0"},
+		{"20-fail", "exit 3"},
+		{"30-never", "exit 0"},
+	} {
+		p := filepath.Join(dir, h.name)
+		if err := ioutil.WriteFile(p, []byte("#!/bin/sh\n"+h.body+"\n"),
+			0755); err != nil {
+			t.Fatal(err)
+		}
+		hooks = append(hooks, hook{h.name, p})
+	}
+
+	s := &runState{abspath: dir, stdout: ioutil.Discard, stderr: ioutil.Discard}
+	conf := mirrorConfig{"gitmirror.20-fail.onerror": {hookStop}}
+	err := runHooks(context.Background(), s, conf, hooks, hookContinue,
+		func() io.Reader { return strings.NewReader("") })
+	if err == nil {
+		t.Fatalf("expected an error from the stopping hook")
+	}
+
+	if len(s.hooks) != 3 {
+		t.Fatalf("expected 3 results, got %v", s.hooks)
+	}
+	if s.hooks[0].Error != "" || s.hooks[1].Error == "" ||
+		s.hooks[2].Skipped == "" {
+		t.Errorf("unexpected results: %v", s.hooks)
+	}
+}
+
+func TestRunHooksTimeoutKillsChildren(t *testing.T) {
+	dir := t.TempDir()
+	p := filepath.Join(dir, "slow")
+	// sleep is a child of the shell, and holds on to its stderr.
+	if err := ioutil.WriteFile(p, []byte("#!/bin/sh\nsleep 5\necho done\n"),
+		0755); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &runState{abspath: dir, stdout: ioutil.Discard, stderr: ioutil.Discard}
+	conf := mirrorConfig{"gitmirror.slow.timeout": {"200ms"}}
+	start := time.Now()
+	runHooks(context.Background(), s, conf, []hook{{"slow", p}}, hookContinue,
+		func() io.Reader { return strings.NewReader("") })
+
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("hook took %v to time out", d)
+	}
+	if len(s.hooks) != 1 || s.hooks[0].Error == "" {
+		t.Errorf("expected the hook to fail, got %v", s.hooks)
+	}
+}
+
+// gitInit makes an empty bare repository at p.
+func gitInit(t *testing.T, p string) {
+	t.Helper()
+	if out, err := exec.Command(*git, "init", "-q", "--bare",
+		p).CombinedOutput(); err != nil {
+		t.Fatalf("git init: %v\n%s", err, out)
+	}
+}
+
+// writeHook writes a global hook (in -dir/bin) with the given body.
+func writeHook(t *testing.T, name, body string) {
+	t.Helper()
+	bin := filepath.Join(*thePath, "bin")
+	if err := os.MkdirAll(bin, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(bin, name),
+		[]byte("#!/bin/sh\n"+body+"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPreFetchVeto(t *testing.T) {
+	defer func(p string) { *thePath = p }(*thePath)
+	*thePath = t.TempDir()
+
+	src := filepath.Join(t.TempDir(), "src.git")
+	gitInit(t, src)
+	ctx := context.Background()
+	payload := []byte(`{"ref":"refs/heads/master"}`)
+
+	// No hooks yet, so the mirror is created.
+	abspath := filepath.Join(*thePath, "m.git")
+	os.Mkdir(abspath, 0755)
+	runCommands(nil, true, abspath, createJob(ctx, src, payload))
+	if !exists(filepath.Join(abspath, "HEAD")) {
+		t.Fatalf("mirror wasn't created")
+	}
+
+	writeHook(t, "pre-fetch", "grep -q master || exit 0\necho frozen >&2\nexit 1")
+
+	s := &runState{abspath: abspath, stdout: ioutil.Discard, stderr: ioutil.Discard}
+	updateJob(ctx, triggerWebhook, payload)(s)
+	if s.outcome() != outcomeVetoed {
+		t.Errorf("update outcome = %v; want %v", s.outcome(), outcomeVetoed)
+	}
+
+	runCommands(nil, true, abspath, updateJob(ctx, triggerWebhook, payload))
+	h := recentFetches(abspath)
+	if len(h) != 2 {
+		t.Fatalf("expected the clone and the veto in history, got %+v", h)
+	}
+	if e := h[1].Error; !strings.Contains(e, "vetoed by bin/pre-fetch") ||
+		!strings.Contains(e, "frozen") {
+		t.Errorf("vetoed fetch recorded as %q", e)
+	}
+
+	// The hook only minds master.
+	runCommands(nil, true, abspath, updateJob(ctx, triggerWebhook,
+		[]byte(`{"ref":"refs/heads/other"}`)))
+	if h := recentFetches(abspath); len(h) != 3 || h[2].Error != "" {
+		t.Errorf("expected an unvetoed fetch, got %+v", h)
+	}
+
+	// A vetoed create leaves nothing behind.
+	created := filepath.Join(*thePath, "new.git")
+	os.Mkdir(created, 0755)
+	runCommands(nil, true, created, createJob(ctx, src, payload))
+	if exists(created) {
+		t.Errorf("vetoed create left %v behind", created)
+	}
+	if h := recentFetches(created); len(h) != 1 ||
+		!strings.Contains(h[0].Error, "vetoed") {
+		t.Errorf("vetoed create recorded as %+v", h)
+	}
+}
+
+func TestPostCreate(t *testing.T) {
+	defer func(p string) { *thePath = p }(*thePath)
+	*thePath = t.TempDir()
+
+	src := filepath.Join(t.TempDir(), "src.git")
+	gitInit(t, src)
+	marker := filepath.Join(t.TempDir(), "created")
+	writeHook(t, "post-create", "basename $PWD >> "+marker)
+
+	ctx := context.Background()
+	for _, name := range []string{"ok.git", "broken.git"} {
+		remote := src
+		if name == "broken.git" {
+			remote = filepath.Join(t.TempDir(), "missing.git")
+		}
+		abspath := filepath.Join(*thePath, name)
+		os.Mkdir(abspath, 0755)
+		runCommands(nil, true, abspath, createJob(ctx, remote, nil))
+	}
+
+	b, err := ioutil.ReadFile(marker)
+	if err != nil {
+		t.Fatalf("post-create never ran: %v", err)
+	}
+	if got := string(b); got != "ok.git\n" {
+		t.Errorf("post-create ran for %q; want only ok.git", got)
+	}
+}
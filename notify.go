@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How many times to try delivering a notification, and how long to
+// wait before the first retry (doubling after that).
+var (
+	notifyAttempts = 4
+	notifyBackoff  = 2 * time.Second
+)
+
+var notifyClient = &http.Client{Timeout: 30 * time.Second}
+
+// updateEvent is what gets posted to notification targets after an
+// update.
+type updateEvent struct {
+	Repo    string      `json:"repo"`
+	Trigger string      `json:"trigger"`
+	Outcome string      `json:"outcome"`
+	Error   string      `json:"error,omitempty"`
+	Changes []refChange `json:"changes"`
+	Time    time.Time   `json:"time"`
+	// Duration of the whole update (hooks and all) in seconds.
+	Duration float64 `json:"duration"`
+}
+
+// Update outcomes.
+const (
+	outcomeOK     = "ok"
+	outcomeFailed = "failed"
+	outcomeVetoed = "vetoed"
+)
+
+func (s *runState) outcome() string {
+	switch {
+	case s.vetoed:
+		return outcomeVetoed
+	case s.fetchErr != nil:
+		return outcomeFailed
+	}
+	return outcomeOK
+}
+
+// notifyTargets returns the global -notify URLs and the mirror's own
+// gitmirror.notify URLs.
+func notifyTargets(conf mirrorConfig) []string {
+	var rv []string
+	for _, u := range strings.Split(*notifyURLs, ",") {
+		if u = strings.TrimSpace(u); u != "" {
+			rv = append(rv, u)
+		}
+	}
+	return append(rv, conf["gitmirror.notify"]...)
+}
+
+// notifyUpdate tells everyone interested in the mirror how an update
+// went.  Delivery happens in the background.
+func notifyUpdate(s *runState, start time.Time) {
+	targets := notifyTargets(loadConfig(context.Background(), s.abspath))
+	if len(targets) == 0 {
+		return
+	}
+
+	ev := updateEvent{
+		Repo:     mirrorName(s.abspath),
+		Trigger:  s.trigger,
+		Outcome:  s.outcome(),
+		Error:    errString(s.fetchErr),
+		Changes:  s.changes,
+		Time:     start,
+		Duration: time.Since(start).Seconds(),
+	}
+	if ev.Changes == nil {
+		ev.Changes = []refChange{}
+	}
+	body, err := json.Marshal(ev)
+	maybePanic(err)
+
+	for _, u := range targets {
+		go deliver(u, body)
+	}
+}
+
+// mirrorName is a mirror's path relative to -dir.
+func mirrorName(abspath string) string {
+	rel, err := filepath.Rel(*thePath, abspath)
+	if err != nil {
+		return abspath
+	}
+	return filepath.ToSlash(rel)
+}
+
+// sign returns the X-Gitmirror-Signature for body.
+func sign(key string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write(body)
+	return fmt.Sprintf("sha256=%x", mac.Sum(nil))
+}
+
+func postEvent(u string, body []byte) error {
+	req, err := http.NewRequest("POST", u, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Gitmirror-Event", "update")
+	if *notifySecret != "" {
+		req.Header.Set("X-Gitmirror-Signature", sign(*notifySecret, body))
+	}
+
+	res, err := notifyClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("HTTP %v", res.Status)
+	}
+	return nil
+}
+
+// deliver posts body to u, retrying with backoff, and dead-letters it
+// if it can't be delivered.
+func deliver(u string, body []byte) {
+	var err error
+	wait := notifyBackoff
+	for i := 0; i < notifyAttempts; i++ {
+		if i > 0 {
+			log.Printf("Retrying notification to %v: %v", u, err)
+			time.Sleep(wait)
+			wait *= 2
+		}
+		if err = postEvent(u, body); err == nil {
+			return
+		}
+	}
+	deadLetter(u, body, err)
+}
+
+var deadLetterMu sync.Mutex
+
+// deadLetter records a notification that couldn't be delivered in the
+// -deadletters file (one JSON object per line), or the log if there
+// isn't one.
+func deadLetter(u string, body []byte, err error) {
+	log.Printf("Giving up on notification to %v: %v", u, err)
+	if *deadLetters == "" {
+		log.Printf("Undelivered notification: %s", body)
+		return
+	}
+
+	line, jerr := json.Marshal(struct {
+		Time  time.Time       `json:"time"`
+		URL   string          `json:"url"`
+		Error string          `json:"error"`
+		Event json.RawMessage `json:"event"`
+	}{time.Now(), u, err.Error(), body})
+	maybePanic(jerr)
+
+	deadLetterMu.Lock()
+	defer deadLetterMu.Unlock()
+
+	f, ferr := os.OpenFile(*deadLetters,
+		os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if ferr != nil {
+		log.Printf("Error opening %v: %v", *deadLetters, ferr)
+		return
+	}
+	defer f.Close()
+	if _, ferr := f.Write(append(line, '\n')); ferr != nil {
+		log.Printf("Error writing %v: %v", *deadLetters, ferr)
+	}
+}
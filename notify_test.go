@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDeliverRetries(t *testing.T) {
+	defer func(b time.Duration, s string) {
+		notifyBackoff, *notifySecret = b, s
+	}(notifyBackoff, *notifySecret)
+	notifyBackoff = time.Millisecond
+	*notifySecret = "hi"
+
+	var mu sync.Mutex
+	attempts := 0
+	var got updateEvent
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		attempts++
+		if attempts < 3 {
+			http.Error(w, "not yet", http.StatusServiceUnavailable)
+			return
+		}
+
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if sig := req.Header.Get("X-Gitmirror-Signature"); sig != sign("hi", body) {
+			t.Errorf("bad signature %q", sig)
+		}
+		if err := json.Unmarshal(body, &got); err != nil {
+			t.Errorf("bad event %s: %v", body, err)
+		}
+	}))
+	defer srv.Close()
+
+	body, err := json.Marshal(updateEvent{Repo: "dustin/gitmirror.git",
+		Outcome: outcomeOK, Changes: []refChange{{"refs/heads/x", refCreated, "", "a1"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	deliver(srv.URL, body)
+
+	if attempts != 3 {
+		t.Errorf("expected 3 attempts, got %v", attempts)
+	}
+	if got.Repo != "dustin/gitmirror.git" || len(got.Changes) != 1 {
+		t.Errorf("unexpected event: %+v", got)
+	}
+}
+
+func TestDeadLetter(t *testing.T) {
+	defer func(d string) { *deadLetters = d }(*deadLetters)
+	*deadLetters = filepath.Join(t.TempDir(), "dead")
+
+	deadLetter("http://example.com/", []byte(`{"repo":"x"}`), errors.New("nope"))
+	deadLetter("http://example.com/", []byte(`{"repo":"y"}`), errors.New("nope"))
+
+	b, err := ioutil.ReadFile(*deadLetters)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 dead letters, got %q", b)
+	}
+
+	var d struct {
+		URL   string
+		Error string
+		Event updateEvent
+	}
+	if err := json.Unmarshal([]byte(lines[1]), &d); err != nil {
+		t.Fatal(err)
+	}
+	if d.URL != "http://example.com/" || d.Error != "nope" || d.Event.Repo != "y" {
+		t.Errorf("unexpected dead letter: %+v", d)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"text/template/parse"
+)
+
+// hookTemplate is -template, parsed.  It's the same template given to
+// setuphooks, so deliveries from an organization's hook can be mapped
+// to the mirror a per-repository hook would have been pointed at.
+var hookTemplate *template.Template
+
+// templateRepo is what setuphooks fills its template in with.
+type templateRepo struct {
+	ID    int
+	Owner struct {
+		Login string
+		ID    int
+	}
+	Name     string
+	FullName string `json:"full_name"`
+	Language *string
+}
+
+// templatePrefix is what's stripped from a rendered -template to get a
+// mirror's path: -prefix, or else the template up to its first action.
+func templatePrefix() string {
+	if *tmplPrefix != "" || hookTemplate == nil {
+		return *tmplPrefix
+	}
+	nodes := hookTemplate.Tree.Root.Nodes
+	if len(nodes) > 0 {
+		if t, ok := nodes[0].(*parse.TextNode); ok {
+			return string(t.Text)
+		}
+	}
+	return ""
+}
+
+// isOrgDelivery reports whether a POST to path (as getPath gives it)
+// is from an organization hook.  setuphooks points those at the
+// template's prefix, which is the root unless gitmirror is reached
+// through a path (or a proxy that strips one).
+func isOrgDelivery(path string) bool {
+	if hookTemplate == nil {
+		return false
+	}
+	if path == "" {
+		return true
+	}
+	u, err := url.Parse(templatePrefix())
+	if err != nil {
+		return false
+	}
+	p := strings.Trim(u.Path, "/")
+	return p != "" && filepath.FromSlash(p) == path
+}
+
+// templatePath works out which mirror a delivery to the root (i.e. from
+// an organization hook) is for.  Repository events for a rename or
+// transfer are mapped by the repository's old name, since that's where
+// the mirror still is.
+func templatePath(payload []byte, repoEvent bool) (string, error) {
+	p := struct{ Repository templateRepo }{}
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return "", err
+	}
+	r := p.Repository
+	if r.FullName == "" {
+		return "", errors.New("no repository in payload")
+	}
+
+	if repoEvent {
+		var e repositoryEvent
+		json.Unmarshal(payload, &e)
+		if old := e.oldFullName(); old != "" && old != r.FullName {
+			r.FullName, r.Name = old, shortName(old)
+			r.Owner.Login = old[:strings.Index(old, "/")]
+		}
+	}
+
+	b := bytes.Buffer{}
+	if err := hookTemplate.Execute(&b, r); err != nil {
+		return "", err
+	}
+	u := b.String()
+	prefix := templatePrefix()
+	if !strings.HasPrefix(u, prefix) {
+		return "", fmt.Errorf("%q doesn't start with %q", u, prefix)
+	}
+	name := strings.TrimPrefix(u, prefix)
+	if _, err := mirrorPath(name); err != nil {
+		return "", err
+	}
+	return filepath.FromSlash(strings.Trim(name, "/")), nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"text/template"
+)
+
+const testRepoPayload = `{
+  "action": "renamed",
+  "changes": {"repository": {"name": {"from": "oldname"}}},
+  "repository": {
+    "id": 42, "name": "gitmirror", "full_name": "dustin/gitmirror",
+    "owner": {"login": "dustin", "id": 7}, "language": "Go"
+  }
+}`
+
+func TestTemplatePath(t *testing.T) {
+	defer func(tm *template.Template, p string) {
+		hookTemplate, *tmplPrefix = tm, p
+	}(hookTemplate, *tmplPrefix)
+
+	tests := []struct {
+		tmpl, prefix string
+		repoEvent    bool
+		want         string
+	}{
+		{"http://example.com/gm/{{.FullName}}.git", "", false, "dustin/gitmirror.git"},
+		{"http://example.com/gm/{{.FullName}}.git", "", true, "dustin/oldname.git"},
+		{"http://example.com/gm/{{.Owner.Login}}/{{.Language}}/{{.Name}}.git", "",
+			false, "dustin/Go/gitmirror.git"},
+		{"http://example.com/gm/{{.ID}}", "http://example.com/", false, "gm/42"},
+		{"http://example.com/gm/{{.Name}}", "http://elsewhere/", false, ""},
+		{"http://example.com/gm/../{{.Name}}", "http://example.com/gm/", false, ""},
+		{"http://x/_{{.Owner.ID}}/x", "http://x/", false, ""},
+	}
+
+	for _, test := range tests {
+		hookTemplate = template.Must(template.New("u").Parse(test.tmpl))
+		*tmplPrefix = test.prefix
+		got, err := templatePath([]byte(testRepoPayload), test.repoEvent)
+		if test.want == "" {
+			if err == nil {
+				t.Errorf("%v: expected error, got %q", test.tmpl, got)
+			}
+			continue
+		}
+		if err != nil || got != test.want {
+			t.Errorf("%v: got %q, %v; want %q", test.tmpl, got, err, test.want)
+		}
+	}
+
+	if _, err := templatePath([]byte(`{"zen": "ping"}`), false); err == nil {
+		t.Errorf("Expected error for payload without a repository")
+	}
+}
+
+func TestOrgHookDelivery(t *testing.T) {
+	defer func(tm *template.Template, p, s string) {
+		hookTemplate, *thePath, *secret = tm, p, s
+	}(hookTemplate, *thePath, *secret)
+	hookTemplate = template.Must(template.New("u").Parse(
+		"http://example.com/gm/{{.FullName}}.git"))
+	*thePath, *secret = t.TempDir(), ""
+
+	// setuphooks points org hooks at the template's prefix, but a
+	// proxy might strip that.
+	tests := []struct {
+		path, event, payload string
+		want                 int
+		body                 string
+	}{
+		{"/", "ping", `{"zen": "hi"}`, http.StatusOK, "pong"},
+		{"/", "push", `{"zen": "hi"}`, http.StatusBadRequest, "no repository"},
+		// Mapped to dustin/oldname.git, which doesn't exist.
+		{"/", "repository", testRepoPayload, http.StatusNotFound, "Not found"},
+		{"/gm/", "ping", `{"zen": "hi"}`, http.StatusOK, "pong"},
+		{"/gm", "push", `{"zen": "hi"}`, http.StatusBadRequest, "no repository"},
+		{"/gm/", "repository", testRepoPayload, http.StatusNotFound, "Not found"},
+	}
+	for _, test := range tests {
+		body := url.Values{"payload": {test.payload}}.Encode()
+		req := httptest.NewRequest("POST", test.path, strings.NewReader(body))
+		req.Header.Set("X-GitHub-Event", test.event)
+		w := httptest.NewRecorder()
+		handlePost(w, req, false)
+		if w.Code != test.want || !strings.Contains(w.Body.String(), test.body) {
+			t.Errorf("%v to %v: got %v %q; want %v %q", test.event, test.path,
+				w.Code, w.Body.String(), test.want, test.body)
+		}
+	}
+	if exists(filepath.Join(*thePath, "gm")) {
+		t.Errorf("the template's prefix was taken for a mirror")
+	}
+}
+
+func TestIsOrgDelivery(t *testing.T) {
+	defer func(tm *template.Template, p string) {
+		hookTemplate, *tmplPrefix = tm, p
+	}(hookTemplate, *tmplPrefix)
+
+	tests := []struct {
+		tmpl, prefix, path string
+		want               bool
+	}{
+		{"", "", "", false},
+		{"http://example.com/{{.FullName}}", "", "", true},
+		{"http://example.com/{{.FullName}}", "", "dustin", false},
+		{"http://example.com/gitmirror/{{.FullName}}.git", "", "", true},
+		{"http://example.com/gitmirror/{{.FullName}}.git", "", "gitmirror", true},
+		{"http://example.com/gitmirror/{{.FullName}}.git", "", "other", false},
+		{"http://example.com/a/b/{{.Name}}", "", "a/b", true},
+		{"http://example.com/a/b/{{.Name}}", "http://example.com/a/", "a", true},
+		{"http://example.com/a/b/{{.Name}}", "http://example.com/a/", "a/b", false},
+	}
+	for _, test := range tests {
+		hookTemplate = nil
+		if test.tmpl != "" {
+			hookTemplate = template.Must(template.New("u").Parse(test.tmpl))
+		}
+		*tmplPrefix = test.prefix
+		if got := isOrgDelivery(filepath.FromSlash(test.path)); got != test.want {
+			t.Errorf("isOrgDelivery(%q) with %q (prefix %q) = %v; want %v",
+				test.path, test.tmpl, test.prefix, got, test.want)
+		}
+	}
+}
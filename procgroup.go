@@ -0,0 +1,30 @@
+package main
+
+import (
+	"context"
+	"os/exec"
+)
+
+// runGroup runs cmd in a process group of its own, killing the whole
+// group if ctx is done before it finishes.
+func runGroup(ctx context.Context, cmd *exec.Cmd) error {
+	if ctx.Done() == nil {
+		return cmd.Run()
+	}
+
+	setGroup(cmd)
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	finished := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			killGroup(cmd)
+		case <-finished:
+		}
+	}()
+	err := cmd.Wait()
+	close(finished)
+	return err
+}
@@ -0,0 +1,11 @@
+package main
+
+import "os/exec"
+
+// Windows has no process groups to speak of, so only the command
+// itself can be killed.
+func setGroup(cmd *exec.Cmd) {}
+
+func killGroup(cmd *exec.Cmd) {
+	cmd.Process.Kill()
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// pushResult is the outcome of pushing a mirror onward to one target.
+type pushResult struct {
+	Target   string        `json:"target"`
+	Duration time.Duration `json:"duration"`
+	Error    string        `json:"error,omitempty"`
+}
+
+func (r pushResult) String() string {
+	if r.Error != "" {
+		return fmt.Sprintf("%v: %v after %v", r.Target, r.Error, r.Duration)
+	}
+	return fmt.Sprintf("%v: ok after %v", r.Target, r.Duration)
+}
+
+// pushArgs returns the git arguments for a gitmirror.push setting:
+// either just a target URL (mirrored in full) or a target followed by
+// the refspecs to push to it.
+func pushArgs(spec string) (target string, args []string) {
+	f := strings.Fields(spec)
+	if len(f) == 0 {
+		return "", nil
+	}
+	if len(f) == 1 {
+		return f[0], []string{"push", "--mirror", f[0]}
+	}
+	return f[0], append([]string{"push", f[0]}, f[1:]...)
+}
+
+// runPushes pushes a freshly fetched mirror to each of its
+// gitmirror.push targets.
+func runPushes(ctx context.Context, s *runState) {
+	conf := loadConfig(ctx, s.abspath)
+	for _, spec := range conf["gitmirror.push"] {
+		target, args := pushArgs(spec)
+		if target == "" {
+			continue
+		}
+
+		start := time.Now()
+		err := s.run(remoteCommand(ctx, target, 0, args...))
+		s.pushes = append(s.pushes, pushResult{target,
+			time.Since(start), errString(err)})
+	}
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPushArgs(t *testing.T) {
+	tests := []struct {
+		spec   string
+		target string
+		args   []string
+	}{
+		{"", "", nil},
+		{"git@backup:x.git", "git@backup:x.git",
+			[]string{"push", "--mirror", "git@backup:x.git"}},
+		{" backup  refs/heads/*:refs/heads/* refs/tags/*:refs/tags/*", "backup",
+			[]string{"push", "backup", "refs/heads/*:refs/heads/*", "refs/tags/*:refs/tags/*"}},
+	}
+
+	for _, test := range tests {
+		target, args := pushArgs(test.spec)
+		if target != test.target || !reflect.DeepEqual(args, test.args) {
+			t.Errorf("pushArgs(%q) = %q, %q; want %q, %q",
+				test.spec, target, args, test.target, test.args)
+		}
+	}
+}
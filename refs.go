@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"sort"
+	"strings"
+)
+
+const zeroID = "0000000000000000000000000000000000000000"
+
+// Kinds of ref changes.
+const (
+	refCreated = "created"
+	refUpdated = "updated"
+	refDeleted = "deleted"
+	refForced  = "forced"
+)
+
+// A refChange describes how a single ref moved during a fetch.
+type refChange struct {
+	Ref  string `json:"ref"`
+	Type string `json:"type"`
+	Old  string `json:"old,omitempty"`
+	New  string `json:"new,omitempty"`
+}
+
+// snapshotRefs returns the object each ref in the repository at
+// abspath points to.
+func snapshotRefs(ctx context.Context, abspath string) (map[string]string, error) {
+	out, err := exec.CommandContext(ctx, *git, "--git-dir="+abspath,
+		"for-each-ref", "--format=%(objectname) %(refname)").Output()
+	if err != nil {
+		return nil, err
+	}
+
+	rv := map[string]string{}
+	s := bufio.NewScanner(bytes.NewReader(out))
+	for s.Scan() {
+		parts := strings.SplitN(s.Text(), " ", 2)
+		if len(parts) == 2 {
+			rv[parts[1]] = parts[0]
+		}
+	}
+	return rv, s.Err()
+}
+
+// isAncestor reports whether old is an ancestor of new in the
+// repository at abspath.  Anything git can't answer (e.g. refs to
+// non-commits) is treated as a fast-forward.
+func isAncestor(ctx context.Context, abspath, old, new string) bool {
+	err := exec.CommandContext(ctx, *git, "--git-dir="+abspath,
+		"merge-base", "--is-ancestor", old, new).Run()
+	var ee *exec.ExitError
+	if errors.As(err, &ee) {
+		return ee.ExitCode() != 1
+	}
+	return true
+}
+
+// diffRefs compares two ref snapshots and returns the changes between
+// them, sorted by ref name.
+func diffRefs(before, after map[string]string,
+	ancestor func(old, new string) bool) []refChange {
+
+	var rv []refChange
+	for ref, n := range after {
+		o, ok := before[ref]
+		switch {
+		case !ok:
+			rv = append(rv, refChange{ref, refCreated, "", n})
+		case o == n:
+		case ancestor(o, n):
+			rv = append(rv, refChange{ref, refUpdated, o, n})
+		default:
+			rv = append(rv, refChange{ref, refForced, o, n})
+		}
+	}
+	for ref, o := range before {
+		if _, ok := after[ref]; !ok {
+			rv = append(rv, refChange{ref, refDeleted, o, ""})
+		}
+	}
+
+	sort.Slice(rv, func(i, j int) bool { return rv[i].Ref < rv[j].Ref })
+	return rv
+}
+
+func orZero(id string) string {
+	if id == "" {
+		return zeroID
+	}
+	return id
+}
+
+// writeRefLines writes changes in the same "<old> <new> <ref>" form
+// git gives a post-receive hook.
+func writeRefLines(w io.Writer, changes []refChange) {
+	for _, c := range changes {
+		fmt.Fprintf(w, "%v %v %v\n", orZero(c.Old), orZero(c.New), c.Ref)
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestDiffRefs(t *testing.T) {
+	before := map[string]string{
+		"refs/heads/master": "a1",
+		"refs/heads/same":   "b1",
+		"refs/heads/gone":   "c1",
+		"refs/heads/forced": "d1",
+	}
+	after := map[string]string{
+		"refs/heads/master": "a2",
+		"refs/heads/same":   "b1",
+		"refs/heads/forced": "d2",
+		"refs/tags/v1":      "e1",
+	}
+
+	got := diffRefs(before, after, func(o, n string) bool {
+		return o != "d1"
+	})
+	want := []refChange{
+		{"refs/heads/forced", refForced, "d1", "d2"},
+		{"refs/heads/gone", refDeleted, "c1", ""},
+		{"refs/heads/master", refUpdated, "a1", "a2"},
+		{"refs/tags/v1", refCreated, "", "e1"},
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("diffRefs() = %v; want %v", got, want)
+	}
+}
+
+func TestWriteRefLines(t *testing.T) {
+	b := &bytes.Buffer{}
+	writeRefLines(b, []refChange{
+		{"refs/heads/a", refCreated, "", "a1"},
+		{"refs/heads/b", refDeleted, "b1", ""},
+	})
+
+	want := zeroID + " a1 refs/heads/a\n" + "b1 " + zeroID + " refs/heads/b\n"
+	if b.String() != want {
+		t.Errorf("got %q; want %q", b.String(), want)
+	}
+}
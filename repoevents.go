@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// repositoryEvent is the part of a github "repository" webhook we care
+// about.
+type repositoryEvent struct {
+	Action  string
+	Changes struct {
+		Repository struct {
+			Name struct{ From string }
+		}
+		Owner struct {
+			From struct {
+				User         struct{ Login string }
+				Organization struct{ Login string }
+			}
+		}
+	}
+	Repository struct {
+		Name     string
+		FullName string `json:"full_name"`
+	}
+}
+
+// oldFullName is what the repository was called before it was renamed
+// or transferred.
+func (e repositoryEvent) oldFullName() string {
+	parts := strings.SplitN(e.Repository.FullName, "/", 2)
+	if len(parts) != 2 {
+		return ""
+	}
+	owner, name := parts[0], parts[1]
+	if n := e.Changes.Repository.Name.From; n != "" {
+		name = n
+	}
+	if o := e.Changes.Owner.From.User.Login; o != "" {
+		owner = o
+	}
+	if o := e.Changes.Owner.From.Organization.Login; o != "" {
+		owner = o
+	}
+	return owner + "/" + name
+}
+
+// renameRemote points a remote URL for repository oldName (owner/name)
+// at newName instead, keeping its host and protocol.
+func renameRemote(remote, oldName, newName string) (string, bool) {
+	re := regexp.MustCompile(`([/:])` + regexp.QuoteMeta(oldName) +
+		`(\.git)?/?$`)
+	if !re.MatchString(remote) {
+		return remote, false
+	}
+	return re.ReplaceAllString(remote, "${1}"+newName+"${2}"), true
+}
+
+// aliasFor returns where a mirror at section would live had it been
+// created under the repository's new name, if that's different.
+func aliasFor(section, oldName, newName string) string {
+	s := filepath.ToSlash(section)
+	if strings.Contains(s, oldName) {
+		return filepath.FromSlash(strings.Replace(s, oldName, newName, 1))
+	}
+
+	oldBase, newBase := shortName(oldName), shortName(newName)
+	dir, base := filepath.Split(section)
+	if oldBase != newBase && strings.HasPrefix(base, oldBase) {
+		return filepath.Join(dir, newBase+strings.TrimPrefix(base, oldBase))
+	}
+	return section
+}
+
+// canonicalPath is the path of the mirror an alias left by a rename
+// refers to, so the mirror's work is queued (and its history kept)
+// under one name.  It's still under -dir as given, even if -dir is
+// itself a symlink.
+func canonicalPath(abspath string) string {
+	target, err := filepath.EvalSymlinks(abspath)
+	if err != nil {
+		return abspath
+	}
+	root, err := filepath.EvalSymlinks(*thePath)
+	if err != nil {
+		return abspath
+	}
+	rel, err := filepath.Rel(root, target)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return abspath
+	}
+	return filepath.Join(*thePath, rel)
+}
+
+// aliasesOf finds the symlinks (left by moveUpstream) under -dir that
+// lead to the mirror at abspath.
+func aliasesOf(abspath string) []string {
+	var rv []string
+	bin := filepath.Join(*thePath, "bin")
+	filepath.Walk(*thePath, func(p string, info os.FileInfo, err error) error {
+		switch {
+		case err != nil:
+		case info.Mode()&os.ModeSymlink != 0:
+			if canonicalPath(p) == abspath {
+				rv = append(rv, p)
+			}
+		case p == bin || (p != *thePath && info.IsDir() && isMirror(p)):
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	return rv
+}
+
+// retargetAliases points aliases (of a mirror that's moved) at to, or
+// with to == "", removes them.
+func retargetAliases(aliases []string, to string) error {
+	for _, a := range aliases {
+		if err := os.Remove(a); err != nil {
+			return err
+		}
+		if to == "" {
+			continue
+		}
+		target, err := filepath.Rel(filepath.Dir(a), to)
+		if err == nil {
+			err = os.Symlink(target, a)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// shortName is the name part of owner/name.
+func shortName(fullName string) string {
+	return fullName[strings.LastIndex(fullName, "/")+1:]
+}
+
+// handleRepositoryEvent keeps a mirror in step with what happened to
+// its upstream repository:
+//
+//   - renamed, transferred: the remote is pointed at the new name, and
+//     a symlink from where the mirror would now live is added
+//   - deleted, archived: the mirror is archived, so it's not fetched
+//   - unarchived: the mirror is fetched again
+func handleRepositoryEvent(w http.ResponseWriter, section string, payload []byte) {
+	var e repositoryEvent
+	if err := json.Unmarshal(payload, &e); err != nil {
+		log.Printf("Error unmarshalling data: %v", err)
+		http.Error(w, "Error parsing JSON", http.StatusBadRequest)
+		return
+	}
+
+	abspath := filepath.Join(*thePath, section)
+	if !exists(abspath) {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	var msg string
+	var err error
+	ctx := context.Background()
+	<-queueJob(abspath, func(s *runState) {
+		switch e.Action {
+		case "renamed", "transferred":
+			msg, err = moveUpstream(ctx, s, section, e, payload)
+		case "deleted", "archived":
+			err = setArchived(ctx, abspath, true)
+			msg = "Archived mirror after upstream was " + e.Action
+		case "unarchived":
+			err = setArchived(ctx, abspath, false)
+			msg = "Unarchived mirror"
+		default:
+			msg = "Ignoring repository " + e.Action
+		}
+	})
+
+	if err != nil {
+		log.Printf("Error handling repository %v of %v: %v",
+			e.Action, abspath, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("%v: %v", abspath, msg)
+	fmt.Fprintln(w, msg)
+}
+
+// moveUpstream follows a renamed or transferred repository.
+func moveUpstream(ctx context.Context, s *runState, section string,
+	e repositoryEvent, payload []byte) (string, error) {
+
+	oldName, newName := e.oldFullName(), e.Repository.FullName
+	if oldName == "" || oldName == newName {
+		return "Nothing to follow", nil
+	}
+
+	remote, ok := renameRemote(remoteURL(ctx, s.abspath), oldName, newName)
+	if !ok {
+		var err error
+		if remote, err = cloneURL(payload); err != nil {
+			return "", err
+		}
+	}
+	if err := s.run(exec.CommandContext(ctx, *git,
+		"remote", "set-url", "origin", remote)); err != nil {
+		return "", err
+	}
+	msg := fmt.Sprintf("Now fetching %v from %v", newName, remote)
+
+	alias := aliasFor(section, oldName, newName)
+	aliasPath, err := mirrorPath(filepath.ToSlash(alias))
+	if err == nil && alias != section && !exists(aliasPath) {
+		target, err := filepath.Rel(filepath.Dir(aliasPath), s.abspath)
+		if err == nil {
+			err = os.MkdirAll(filepath.Dir(aliasPath), os.ModePerm)
+		}
+		if err == nil {
+			err = os.Symlink(target, aliasPath)
+		}
+		if err != nil {
+			return "", err
+		}
+		msg += fmt.Sprintf(", also known as %v", alias)
+	}
+	return msg, nil
+}
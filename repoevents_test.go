@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRenameRemote(t *testing.T) {
+	tests := []struct {
+		remote string
+		want   string
+		ok     bool
+	}{
+		{"https://github.com/dustin/old.git", "https://github.com/dustin/new.git", true},
+		{"https://github.com/dustin/old", "https://github.com/dustin/new", true},
+		{"git@github.com:dustin/old.git", "git@github.com:dustin/new.git", true},
+		{"https://github.com/dustin/older.git", "https://github.com/dustin/older.git", false},
+		{"https://github.com/notdustin/old.git", "https://github.com/notdustin/old.git", false},
+	}
+
+	for _, test := range tests {
+		got, ok := renameRemote(test.remote, "dustin/old", "dustin/new")
+		if got != test.want || ok != test.ok {
+			t.Errorf("renameRemote(%q) = %q, %v; want %q, %v",
+				test.remote, got, ok, test.want, test.ok)
+		}
+	}
+}
+
+func TestAliasFor(t *testing.T) {
+	tests := []struct {
+		section, oldName, newName, want string
+	}{
+		{"dustin/old.git", "dustin/old", "dustin/new", "dustin/new.git"},
+		{"dustin/old.git", "dustin/old", "someorg/old", "someorg/old.git"},
+		{"mirrors/old.git", "dustin/old", "dustin/new", "mirrors/new.git"},
+		{"mirrors/old.git", "dustin/old", "someorg/old", "mirrors/old.git"},
+		{"12345.git", "dustin/old", "dustin/new", "12345.git"},
+	}
+
+	for _, test := range tests {
+		got := aliasFor(test.section, test.oldName, test.newName)
+		if got != test.want {
+			t.Errorf("aliasFor(%q, %q, %q) = %q; want %q",
+				test.section, test.oldName, test.newName, got, test.want)
+		}
+	}
+}
+
+func TestOldFullName(t *testing.T) {
+	tests := []struct {
+		payload string
+		want    string
+	}{
+		{`{"action": "renamed",
+		   "changes": {"repository": {"name": {"from": "old"}}},
+		   "repository": {"name": "new", "full_name": "dustin/new"}}`,
+			"dustin/old"},
+		{`{"action": "transferred",
+		   "changes": {"owner": {"from": {"user": {"login": "dustin"}}}},
+		   "repository": {"name": "x", "full_name": "someorg/x"}}`,
+			"dustin/x"},
+		{`{"action": "transferred",
+		   "changes": {"owner": {"from": {"organization": {"login": "o"}}}},
+		   "repository": {"name": "x", "full_name": "dustin/x"}}`,
+			"o/x"},
+	}
+
+	for _, test := range tests {
+		var e repositoryEvent
+		if err := json.Unmarshal([]byte(test.payload), &e); err != nil {
+			t.Fatal(err)
+		}
+		if got := e.oldFullName(); got != test.want {
+			t.Errorf("oldFullName() = %q; want %q", got, test.want)
+		}
+	}
+}
+
+func TestCanonicalPath(t *testing.T) {
+	defer func(p string) { *thePath = p }(*thePath)
+	tmp := t.TempDir()
+	realDir := filepath.Join(tmp, "real")
+	// -dir is reached through a symlink of its own.
+	*thePath = filepath.Join(tmp, "mirrors")
+	if err := os.Symlink("real", *thePath); err != nil {
+		t.Fatal(err)
+	}
+	gitInit(t, filepath.Join(realDir, "dustin", "old.git"))
+	if err := os.MkdirAll(filepath.Join(realDir, "someorg"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for alias, target := range map[string]string{
+		"dustin/new.git":  "old.git",
+		"someorg/old.git": "../dustin/old.git",
+		"outside.git":     "..",
+	} {
+		if err := os.Symlink(target, filepath.Join(realDir, alias)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	old := filepath.Join(*thePath, "dustin", "old.git")
+	tests := map[string]string{
+		"dustin/old.git":  old,
+		"dustin/new.git":  old,
+		"someorg/old.git": old,
+		"outside.git":     filepath.Join(*thePath, "outside.git"),
+		"dustin/gone.git": filepath.Join(*thePath, "dustin", "gone.git"),
+	}
+	for section, want := range tests {
+		if got := canonicalPath(filepath.Join(*thePath, section)); got != want {
+			t.Errorf("canonicalPath(%v) = %v; want %v", section, got, want)
+		}
+	}
+
+	// Fetches through the alias are the mirror's fetches.
+	recordFetch(old, fetchRecord{Start: time.Now()})
+	defer forgetFetches(old)
+	if h := recentFetches(filepath.Join(*thePath, "dustin", "new.git")); len(h) != 1 {
+		t.Errorf("history through the alias = %+v", h)
+	}
+}
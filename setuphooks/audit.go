@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/dustin/go-jsonpointer"
+)
+
+// auditHook is what the audit says about one of a repo's hooks.
+type auditHook struct {
+	ID        int      `json:"id"`
+	URL       string   `json:"url"`
+	Events    []string `json:"events"`
+	Active    bool     `json:"active"`
+	Gitmirror bool     `json:"gitmirror"`
+	// Whether a gitmirror hook is set up as the template says.
+	Matches bool     `json:"matches"`
+	Drift   []string `json:"drift,omitempty"`
+
+	LastCode    int    `json:"last_code,omitempty"`
+	LastStatus  string `json:"last_status"`
+	LastMessage string `json:"last_message,omitempty"`
+}
+
+// delivered reports whether the hook's last delivery worked (or there
+// hasn't been one yet).
+func (h auditHook) delivered() bool {
+	if h.LastCode == 0 {
+		return h.LastStatus == "" || h.LastStatus == "unused"
+	}
+	return h.LastCode >= 200 && h.LastCode < 300
+}
+
+// auditRecord is what the audit says about a repo.
+type auditRecord struct {
+	Repo         string `json:"repo"`
+	HasGitmirror bool   `json:"has_gitmirror"`
+	// Whether there's a gitmirror hook that matches, is active, and
+	// last delivered successfully.
+	Mirroring bool        `json:"mirroring"`
+	Hooks     []auditHook `json:"hooks"`
+	Error     string      `json:"error,omitempty"`
+}
+
+// summary is a few words on the record, for the results table.
+func (a auditRecord) summary() string {
+	switch {
+	case a.Mirroring:
+		return "mirroring"
+	case !a.HasGitmirror:
+		return "no gitmirror hook"
+	}
+	for _, h := range a.Hooks {
+		if h.Gitmirror && h.Matches && h.Active && !h.delivered() {
+			return "last delivery failed"
+		}
+	}
+	return "gitmirror hook doesn't match"
+}
+
+func auditHooks(name string, want hook, hooks []hook) auditRecord {
+	rv := auditRecord{Repo: name, Hooks: []auditHook{}}
+	for _, h := range hooks {
+		if h.Name != "web" {
+			continue
+		}
+		u, _ := jsonpointer.Get(h.Config, "/url").(string)
+		ah := auditHook{
+			ID:        h.ID,
+			URL:       u,
+			Events:    h.Events,
+			Active:    h.Active,
+			Gitmirror: ownedHook(want, h),
+		}
+		if ah.Gitmirror {
+			ah.Drift = drift(h, want)
+			ah.Matches = len(ah.Drift) == 0
+			rv.HasGitmirror = true
+		}
+		if lr := h.LastResponse; lr != nil {
+			if lr.Code != nil {
+				ah.LastCode = *lr.Code
+			}
+			ah.LastStatus, ah.LastMessage = lr.Status, lr.Message
+		}
+		if ah.Matches && ah.Active && ah.delivered() {
+			rv.Mirroring = true
+		}
+		rv.Hooks = append(rv.Hooks, ah)
+	}
+	return rv
+}
+
+func auditRepo(r repo) auditRecord {
+	want, err := desiredHook(r)
+	if err != nil {
+		return auditRecord{Repo: r.FullName, Error: err.Error()}
+	}
+	hooks := []hook{}
+	if _, err := getJSON(r.FullName, repoHooks(r), &hooks); err != nil {
+		return auditRecord{Repo: r.FullName, Error: err.Error()}
+	}
+	return auditHooks(r.FullName, want, hooks)
+}
+
+var csvHeader = []string{"repo", "has_gitmirror", "mirroring", "hook_id",
+	"url", "events", "active", "gitmirror", "matches", "drift",
+	"last_code", "last_status", "last_message", "error"}
+
+// writeCSV writes a row per hook, or just the repo's columns for a
+// repo with no hooks.
+func writeCSV(w io.Writer, records []auditRecord) error {
+	cw := csv.NewWriter(w)
+	cw.Write(csvHeader)
+	for _, a := range records {
+		row := []string{a.Repo, strconv.FormatBool(a.HasGitmirror),
+			strconv.FormatBool(a.Mirroring)}
+		if len(a.Hooks) == 0 {
+			blank := make([]string, len(csvHeader)-len(row)-1)
+			cw.Write(append(append(row, blank...), a.Error))
+			continue
+		}
+		for _, h := range a.Hooks {
+			code := ""
+			if h.LastCode != 0 {
+				code = strconv.Itoa(h.LastCode)
+			}
+			cw.Write(append(row[:3:3], strconv.Itoa(h.ID), h.URL,
+				strings.Join(h.Events, " "), strconv.FormatBool(h.Active),
+				strconv.FormatBool(h.Gitmirror), strconv.FormatBool(h.Matches),
+				strings.Join(h.Drift, " "), code, h.LastStatus, h.LastMessage,
+				a.Error))
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// auditOrgHooks audits -org's own hooks against the hook -orghook
+// would set up.
+func auditOrgHooks() auditRecord {
+	name := "org " + *org
+	hooks := []hook{}
+	if _, err := getJSON(name, orgHooks(), &hooks); err != nil {
+		return auditRecord{Repo: name, Error: err.Error()}
+	}
+	return auditHooks(name, wantHook(templatePrefix()), hooks)
+}
+
+func checkFormat(format string) error {
+	if format != "json" && format != "csv" {
+		return fmt.Errorf("unknown format %q (want json or csv)", format)
+	}
+	return nil
+}
+
+func writeAudit(w io.Writer, format string, records []auditRecord) error {
+	if format == "csv" {
+		return writeCSV(w, records)
+	}
+	e := json.NewEncoder(w)
+	e.SetIndent("", "  ")
+	return e.Encode(records)
+}
+
+// result is what the audit found, for the report.
+func (a auditRecord) result() result {
+	if a.Error != "" {
+		return result{a.Repo, resultFailed, a.Error}
+	}
+	return result{a.Repo, resultOK, a.summary()}
+}
+
+// auditOrg reports on -org's own hooks (i.e. those -orghook manages),
+// in format (json or csv), to w.
+func auditOrg(format string, w io.Writer) error {
+	if err := checkFormat(format); err != nil {
+		return err
+	}
+	a := auditOrgHooks()
+	report.add(a.result())
+	return writeAudit(w, format, []auditRecord{a})
+}
+
+// audit reports on the hooks of every repo, in format (json or csv),
+// to w.
+func audit(repos <-chan repo, format string, w io.Writer) error {
+	if err := checkFormat(format); err != nil {
+		return err
+	}
+
+	var mu sync.Mutex
+	var records []auditRecord
+	forEach(repos, func(r repo) result {
+		a := auditRepo(r)
+		mu.Lock()
+		records = append(records, a)
+		mu.Unlock()
+		return a.result()
+	})
+	sort.Slice(records, func(i, j int) bool { return records[i].Repo < records[j].Repo })
+	return writeAudit(w, format, records)
+}
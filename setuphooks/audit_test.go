@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestAudit(t *testing.T) {
+	defer func(e, s string, sl func(time.Duration)) {
+		*events, *secret, sleep = e, s, sl
+	}(*events, *secret, sleep)
+	*events, *secret, sleep = "push", "", func(time.Duration) {}
+
+	ok, failing := 200, 502
+	repos := []repo{testRepo(1, "dustin/a"), testRepo(2, "dustin/b"),
+		testRepo(3, "dustin/c"), testRepo(4, "dustin/d"), testRepo(5, "dustin/e")}
+	f := newFakeGithub(t, "http://example.com/gitmirror/{{.FullName}}.git", repos...)
+
+	good := webHook("http://example.com/gitmirror/dustin/a.git", true, "push")
+	good.LastResponse = &lastResponse{Code: &ok, Status: "active", Message: "OK"}
+	f.addHook("dustin/a", good)
+	f.addHook("dustin/a", webHook("http://ci.example.com/", true, "push"))
+
+	f.addHook("dustin/b", webHook("http://ci.example.com/", true, "push"))
+
+	bad := webHook("http://example.com/gitmirror/dustin/c.git", true, "push")
+	bad.LastResponse = &lastResponse{Code: &failing, Status: "failed", Message: "Bad Gateway"}
+	f.addHook("dustin/c", bad)
+
+	f.addHook("dustin/d", webHook("http://example.com/gitmirror/old.git", true, "push", "issues"))
+	f.broken["dustin/e"] = true
+
+	run := func(format string) *bytes.Buffer {
+		report = &results{}
+		ch := make(chan repo, len(repos))
+		for _, r := range repos {
+			ch <- r
+		}
+		close(ch)
+		out := &bytes.Buffer{}
+		if err := audit(ch, format, out); err != nil {
+			t.Fatal(err)
+		}
+		return out
+	}
+
+	var records []auditRecord
+	if err := json.Unmarshal(run("json").Bytes(), &records); err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 5 {
+		t.Fatalf("Got %v records: %+v", len(records), records)
+	}
+	want := []struct {
+		has, mirroring bool
+		summary        string
+		hooks          int
+	}{
+		{true, true, "mirroring", 2},
+		{false, false, "no gitmirror hook", 1},
+		{true, false, "last delivery failed", 1},
+		{true, false, "gitmirror hook doesn't match", 1},
+		{false, false, "no gitmirror hook", 0},
+	}
+	for i, w := range want {
+		a := records[i]
+		if a.HasGitmirror != w.has || a.Mirroring != w.mirroring ||
+			a.summary() != w.summary || len(a.Hooks) != w.hooks {
+			t.Errorf("%v: got %+v (%v); want %+v", a.Repo, a, a.summary(), w)
+		}
+	}
+	if d := records[3].Hooks[0]; d.Matches || len(d.Drift) != 2 {
+		t.Errorf("dustin/d's hook = %+v; want url and events drift", d)
+	}
+	if records[4].Error == "" || report.count(resultFailed) != 1 {
+		t.Errorf("Expected dustin/e to fail, got %+v", records[4])
+	}
+
+	rows, err := csv.NewReader(run("csv")).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 7 || len(rows[0]) != len(csvHeader) {
+		t.Fatalf("CSV:\n%q", rows)
+	}
+	if r := rows[1]; r[0] != "dustin/a" || r[2] != "true" || r[7] != "true" ||
+		r[10] != "200" || r[11] != "active" {
+		t.Errorf("First CSV row = %q", r)
+	}
+	if r := rows[6]; r[0] != "dustin/e" || r[3] != "" || r[len(r)-1] == "" {
+		t.Errorf("Last CSV row = %q", r)
+	}
+
+	if err := audit(nil, "xml", &bytes.Buffer{}); err == nil {
+		t.Errorf("Expected error for unknown format")
+	}
+}
+
+func TestAuditOrg(t *testing.T) {
+	defer func(o, e, s string) { *org, *events, *secret = o, e, s }(*org, *events, *secret)
+	*org, *events, *secret = "myorg", "push", ""
+
+	f := newFakeGithub(t, "http://example.com/gitmirror/{{.FullName}}.git")
+
+	run := func() auditRecord {
+		report = &results{}
+		out := &bytes.Buffer{}
+		if err := auditOrg("json", out); err != nil {
+			t.Fatal(err)
+		}
+		var records []auditRecord
+		if err := json.Unmarshal(out.Bytes(), &records); err != nil || len(records) != 1 {
+			t.Fatalf("Got %v, %s", err, out)
+		}
+		return records[0]
+	}
+
+	if a := run(); a.HasGitmirror || a.summary() != "no gitmirror hook" {
+		t.Errorf("Without a hook, got %+v", a)
+	}
+
+	f.addHook("orgs/myorg", webHook("http://example.com/gitmirror/", true, "push"))
+	if a := run(); !a.Mirroring || a.Repo != "org myorg" ||
+		report.count(resultOK) != 1 {
+		t.Errorf("With a hook, got %+v", a)
+	}
+
+	for _, r := range f.requests() {
+		if r != "GET /orgs/myorg/hooks" {
+			t.Errorf("Auditing made request %v", r)
+		}
+	}
+}
+
+func TestAuditSecrets(t *testing.T) {
+	defer func(e, s string) { *events, *secret = e, s }(*events, *secret)
+	*events = "push"
+
+	ok := 200
+	r := testRepo(1, "dustin/a")
+	f := newFakeGithub(t, "http://example.com/gitmirror/{{.FullName}}.git", r)
+	h := webHook("http://example.com/gitmirror/dustin/a.git", true, "push")
+	// Github shows secrets masked.
+	h.Config["secret"] = "********"
+	h.LastResponse = &lastResponse{Code: &ok, Status: "active", Message: "OK"}
+	f.addHook(r.FullName, h)
+
+	// Without -secret (the documented way to audit), a hook's secret
+	// isn't drift; with it, there's no telling if it's the same one.
+	for _, s := range []string{"", "sekrit"} {
+		*secret = s
+		a := auditRepo(r)
+		if !a.Mirroring || len(a.Hooks) != 1 ||
+			!a.Hooks[0].Matches || len(a.Hooks[0].Drift) != 0 {
+			t.Errorf("With -secret=%q, got %+v", s, a)
+		}
+	}
+
+	// With -secret, a hook without one doesn't match.
+	delete(f.hooksOf(r.FullName)[0].Config, "secret")
+	*secret = "sekrit"
+	if a := auditRepo(r); a.Mirroring ||
+		!reflect.DeepEqual(a.Hooks[0].Drift, []string{"secret"}) {
+		t.Errorf("Missing secret, got %+v", a)
+	}
+}
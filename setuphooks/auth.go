@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ghHostsFile is where the gh command line tool keeps its logins.
+func ghHostsFile() string {
+	if d := os.Getenv("GH_CONFIG_DIR"); d != "" {
+		return filepath.Join(d, "hosts.yml")
+	}
+	if d := os.Getenv("XDG_CONFIG_HOME"); d != "" {
+		return filepath.Join(d, "gh", "hosts.yml")
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".config", "gh", "hosts.yml")
+}
+
+// ghToken finds host's oauth_token in gh's hosts.yml.  That's just
+// enough YAML parsing for the file gh writes:
+//
+//	github.com:
+//	    user: dustin
+//	    oauth_token: gho_...
+func ghToken(r io.Reader, host string) string {
+	inHost := false
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		line := s.Text()
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		if line[0] != ' ' && line[0] != '\t' {
+			inHost = strings.TrimSuffix(trimmed, ":") == host
+			continue
+		}
+		if inHost && strings.HasPrefix(trimmed, "oauth_token:") {
+			return strings.Trim(strings.TrimSpace(
+				strings.TrimPrefix(trimmed, "oauth_token:")), `"'`)
+		}
+	}
+	return ""
+}
+
+// apiHost is the host -api belongs to, as gh would name it.
+func apiHost() string {
+	u, err := url.Parse(*api)
+	if err != nil {
+		return ""
+	}
+	if u.Host == "api.github.com" {
+		return "github.com"
+	}
+	return u.Host
+}
+
+// findToken returns the token to use for host: -token (or
+// $GITHUB_TOKEN), else whatever gh is logged in with.
+func findToken(host string) string {
+	if *token != "" {
+		return *token
+	}
+	f, err := os.Open(ghHostsFile())
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	return ghToken(f, host)
+}
+
+// authorize adds credentials to an API request.  Tokens are preferred;
+// username and password only work against github enterprise servers
+// that still allow them.
+func authorize(req *http.Request) {
+	switch {
+	case apiToken != "":
+		req.Header.Set("Authorization", "token "+apiToken)
+	case *username != "" || *password != "":
+		req.SetBasicAuth(*username, *password)
+	}
+}
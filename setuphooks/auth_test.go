@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+const ghHosts = `github.com:
+    user: dustin
+    oauth_token: gho_public
+    git_protocol: https
+ghe.example.com:
+    oauth_token: "gho_enterprise"
+# keyring logins have no oauth_token
+keyring.example.com:
+    user: dustin
+`
+
+func TestGHToken(t *testing.T) {
+	tests := map[string]string{
+		"github.com":          "gho_public",
+		"ghe.example.com":     "gho_enterprise",
+		"keyring.example.com": "",
+		"example.com":         "",
+	}
+	for host, want := range tests {
+		if got := ghToken(strings.NewReader(ghHosts), host); got != want {
+			t.Errorf("ghToken(%q) = %q; want %q", host, got, want)
+		}
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	defer func(tok, u, p string) {
+		apiToken, *username, *password = tok, u, p
+	}(apiToken, *username, *password)
+
+	tests := []struct {
+		token, user, pass string
+		want              string
+	}{
+		{"gho_x", "dustin", "pw", "token gho_x"},
+		{"", "dustin", "pw", "Basic ZHVzdGluOnB3"},
+		{"", "", "", ""},
+	}
+	for _, test := range tests {
+		apiToken, *username, *password = test.token, test.user, test.pass
+		req, err := http.NewRequest("GET", "https://api.github.com/user", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		authorize(req)
+		if got := req.Header.Get("Authorization"); got != test.want {
+			t.Errorf("authorize with %+v = %q; want %q", test, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// A namePattern matches repository names.  It's a glob, or a regexp
+// if it's between slashes.  Patterns with a slash in them (other than
+// regexps) are matched against the full name, others against just the
+// name.
+type namePattern struct {
+	glob string
+	re   *regexp.Regexp
+}
+
+func parsePatterns(s string) ([]namePattern, error) {
+	var rv []namePattern
+	for _, p := range strings.Split(s, ",") {
+		p = strings.TrimSpace(p)
+		switch {
+		case p == "":
+			continue
+		case len(p) > 2 && strings.HasPrefix(p, "/") && strings.HasSuffix(p, "/"):
+			re, err := regexp.Compile(p[1 : len(p)-1])
+			if err != nil {
+				return nil, err
+			}
+			rv = append(rv, namePattern{re: re})
+		default:
+			if _, err := path.Match(p, ""); err != nil {
+				return nil, fmt.Errorf("bad pattern %q: %v", p, err)
+			}
+			rv = append(rv, namePattern{glob: p})
+		}
+	}
+	return rv, nil
+}
+
+func (p namePattern) match(r repo) bool {
+	if p.re != nil {
+		return p.re.MatchString(r.FullName)
+	}
+	name := r.Name
+	if strings.Contains(p.glob, "/") {
+		name = r.FullName
+	}
+	ok, _ := path.Match(p.glob, name)
+	return ok
+}
+
+func matchAny(patterns []namePattern, r repo) bool {
+	for _, p := range patterns {
+		if p.match(r) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseSince parses -pushedsince: a duration back from now, or a date.
+func parseSince(s string, now time.Time) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return now.Add(-d), nil
+	}
+	for _, layout := range []string{"2006-01-02", time.RFC3339} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("bad time %q (want a duration or date)", s)
+}
+
+// The parsed filters.
+var (
+	includes, excludes []namePattern
+	pushedSince        time.Time
+)
+
+func setupFilters() error {
+	var err error
+	if includes, err = parsePatterns(*includeFlag); err != nil {
+		return err
+	}
+	if excludes, err = parsePatterns(*excludeFlag); err != nil {
+		return err
+	}
+	switch *visibility {
+	case "all", "public", "private":
+	default:
+		return fmt.Errorf("bad -visibility %q (want all, public or private)",
+			*visibility)
+	}
+	pushedSince, err = parseSince(*pushedSinceFlag, time.Now())
+	return err
+}
+
+func splitList(s string) []string {
+	var rv []string
+	for _, x := range strings.Split(s, ",") {
+		if x = strings.TrimSpace(x); x != "" {
+			rv = append(rv, x)
+		}
+	}
+	return rv
+}
+
+// containsFold is contains, ignoring case.
+func containsFold(haystack []string, needle string) bool {
+	for _, n := range haystack {
+		if strings.EqualFold(n, needle) {
+			return true
+		}
+	}
+	return false
+}
+
+// skipReason returns why r doesn't get past the filters, if it
+// doesn't.
+func skipReason(r repo) string {
+	switch {
+	case len(includes) > 0 && !matchAny(includes, r):
+		return "not included"
+	case matchAny(excludes, r):
+		return "excluded"
+	case *skipArchived && r.Archived:
+		return "archived"
+	case *skipForks && r.Fork:
+		return "fork"
+	case *visibility == "public" && r.Private,
+		*visibility == "private" && !r.Private:
+		return "not " + *visibility
+	case !pushedSince.IsZero() && r.PushedAt.Before(pushedSince):
+		return "not pushed since " + pushedSince.Format("2006-01-02")
+	}
+
+	if langs := splitList(*languages); len(langs) > 0 &&
+		(r.Language == nil || !containsFold(langs, *r.Language)) {
+		return "language"
+	}
+	if topics := splitList(*topicsFlag); len(topics) > 0 {
+		for _, t := range r.Topics {
+			if containsFold(topics, t) {
+				return ""
+			}
+		}
+		return "topics"
+	}
+	return ""
+}
+
+// filterRepos passes on the repos that get past the filters.
+func filterRepos(in <-chan repo) <-chan repo {
+	rv := make(chan repo)
+	go func() {
+		defer close(rv)
+		for r := range in {
+			if why := skipReason(r); why != "" {
+				if *verbose {
+					log.Printf("Skipping %v (%v)", r.FullName, why)
+				}
+				report.add(result{r.FullName, resultSkipped, why})
+				continue
+			}
+			rv <- r
+		}
+	}()
+	return rv
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseSince(t *testing.T) {
+	now := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	tests := map[string]time.Time{
+		"":                     {},
+		"24h":                  now.Add(-24 * time.Hour),
+		"2020-01-02":           time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC),
+		"2020-01-02T03:04:05Z": time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+	}
+	for in, want := range tests {
+		got, err := parseSince(in, now)
+		if err != nil || !got.Equal(want) {
+			t.Errorf("parseSince(%q) = %v, %v; want %v", in, got, err, want)
+		}
+	}
+	if _, err := parseSince("last tuesday", now); err == nil {
+		t.Errorf("Expected error parsing a bad time")
+	}
+}
+
+func TestSkipReason(t *testing.T) {
+	defer func(i, e, tp, l, v, p string, a, f bool) {
+		*includeFlag, *excludeFlag, *topicsFlag, *languages, *visibility, *pushedSinceFlag = i, e, tp, l, v, p
+		*skipArchived, *skipForks = a, f
+		setupFilters()
+	}(*includeFlag, *excludeFlag, *topicsFlag, *languages, *visibility, *pushedSinceFlag,
+		*skipArchived, *skipForks)
+
+	goLang := "Go"
+	r := testRepo(1, "dustin/gitmirror")
+	r.Language = &goLang
+	r.Topics = []string{"git", "mirroring"}
+	r.PushedAt = time.Now().Add(-48 * time.Hour)
+	archived := r
+	archived.Archived = true
+	fork := r
+	fork.Fork = true
+	private := r
+	private.Private = true
+
+	tests := []struct {
+		include, exclude, topic, lang, vis, since string
+		skipArchived, skipForks                   bool
+		r                                         repo
+		want                                      string
+	}{
+		{r: r},
+		{include: "git*", r: r},
+		{include: "dustin/*", r: r},
+		{include: "couchbase/*", r: r, want: "not included"},
+		{include: "other,/^dustin\\/git/", r: r},
+		{exclude: "*mirror", r: r, want: "excluded"},
+		{exclude: "/^couchbase/", r: r},
+		{skipArchived: true, r: archived, want: "archived"},
+		{r: archived},
+		{skipForks: true, r: fork, want: "fork"},
+		{vis: "public", r: private, want: "not public"},
+		{vis: "private", r: private},
+		{vis: "private", r: r, want: "not private"},
+		{lang: "python,go", r: r},
+		{lang: "python", r: r, want: "language"},
+		{topic: "ci,Mirroring", r: r},
+		{topic: "ci", r: r, want: "topics"},
+		{since: "24h", r: r, want: "not pushed since " + time.Now().Add(-24*time.Hour).Format("2006-01-02")},
+		{since: "72h", r: r},
+	}
+
+	for i, test := range tests {
+		*includeFlag, *excludeFlag, *topicsFlag = test.include, test.exclude, test.topic
+		*languages, *pushedSinceFlag = test.lang, test.since
+		*skipArchived, *skipForks = test.skipArchived, test.skipForks
+		*visibility = "all"
+		if test.vis != "" {
+			*visibility = test.vis
+		}
+		if err := setupFilters(); err != nil {
+			t.Fatalf("#%v: %v", i, err)
+		}
+		if got := skipReason(test.r); got != test.want {
+			t.Errorf("#%v (%+v): skipReason = %q; want %q", i, test, got, test.want)
+		}
+	}
+
+	*visibility = "secret"
+	if err := setupFilters(); err == nil {
+		t.Errorf("Expected error for bad -visibility")
+	}
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"text/template"
+	"time"
+)
+
+// fakeGithub is just enough of the github API for setuphooks.
+type fakeGithub struct {
+	*httptest.Server
+
+	mu     sync.Mutex
+	repos  []repo
+	hooks  map[string][]hook
+	nextID int
+	reqs   []string
+	// repos whose hooks can't be touched
+	broken map[string]bool
+}
+
+const (
+	fakeToken = "gho_fake"
+	// Who fakeToken belongs to.
+	fakeLogin = "octocat"
+)
+
+// newFakeGithub starts a fake github with the given repos, and points
+// setuphooks at it with template tmplText.
+func newFakeGithub(t *testing.T, tmplText string, repos ...repo) *fakeGithub {
+	f := &fakeGithub{repos: repos, hooks: map[string][]hook{}, nextID: 1,
+		broken: map[string]bool{}}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serve))
+	t.Cleanup(f.Close)
+
+	oldAPI, oldToken, oldTmpl, oldReport := *api, apiToken, tmpl, report
+	t.Cleanup(func() { *api, apiToken, tmpl, report = oldAPI, oldToken, oldTmpl, oldReport })
+	report = &results{}
+	*api, apiToken = f.URL, fakeToken
+	tmpl = template.Must(template.New("u").Parse(tmplText))
+	return f
+}
+
+func testRepo(id int, fullName string) repo {
+	r := repo{ID: id, FullName: fullName}
+	parts := strings.SplitN(fullName, "/", 2)
+	r.Owner.Login, r.Name = parts[0], parts[1]
+	return r
+}
+
+// addHook adds a hook to a repo directly, returning its ID.
+func (f *fakeGithub) addHook(fullName string, h hook) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	h.ID = f.nextID
+	f.nextID++
+	f.hooks[fullName] = append(f.hooks[fullName], h)
+	return h.ID
+}
+
+func (f *fakeGithub) hooksOf(fullName string) []hook {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]hook(nil), f.hooks[fullName]...)
+}
+
+// requests returns the "METHOD /path" of every request made so far.
+func (f *fakeGithub) requests() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.reqs...)
+}
+
+func (f *fakeGithub) serve(w http.ResponseWriter, req *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.reqs = append(f.reqs, req.Method+" "+req.URL.Path)
+
+	if req.Header.Get("Authorization") != "token "+fakeToken {
+		http.Error(w, `{"message":"Bad credentials"}`, http.StatusUnauthorized)
+		return
+	}
+
+	parts := strings.Split(strings.Trim(req.URL.Path, "/"), "/")
+	switch {
+	case req.Method == "GET" && req.URL.Path == "/user":
+		fmt.Fprintf(w, `{"login":%q}`, fakeLogin)
+	case req.Method == "GET" && (req.URL.Path == "/user/repos" ||
+		len(parts) == 3 && parts[0] == "orgs" && parts[2] == "repos"):
+		f.listRepos(w, req)
+	case len(parts) >= 3 && parts[0] == "orgs" && parts[2] == "hooks":
+		f.serveHooks(w, req, "orgs/"+parts[1], parts[3:])
+	case len(parts) >= 4 && parts[0] == "repos" && parts[3] == "hooks":
+		f.serveHooks(w, req, parts[1]+"/"+parts[2], parts[4:])
+	default:
+		http.Error(w, `{"message":"Not Found"}`, http.StatusNotFound)
+	}
+}
+
+// listRepos serves repos two at a time, linking to the next page.
+func (f *fakeGithub) listRepos(w http.ResponseWriter, req *http.Request) {
+	page, _ := strconv.Atoi(req.URL.Query().Get("page"))
+	if page < 1 {
+		page = 1
+	}
+	start, end := (page-1)*2, page*2
+	if end >= len(f.repos) {
+		end = len(f.repos)
+	} else {
+		w.Header().Set("Link", fmt.Sprintf(`<%v%v?page=%v>; rel="next"`,
+			f.URL, req.URL.Path, page+1))
+	}
+	if start > end {
+		start = end
+	}
+	json.NewEncoder(w).Encode(f.repos[start:end])
+}
+
+func (f *fakeGithub) serveHooks(w http.ResponseWriter, req *http.Request,
+	fullName string, rest []string) {
+
+	if f.broken[fullName] {
+		http.Error(w, `{"message":"Not Found"}`, http.StatusNotFound)
+		return
+	}
+	hooks := f.hooks[fullName]
+	if len(rest) == 0 {
+		switch req.Method {
+		case "GET":
+			json.NewEncoder(w).Encode(hooks)
+		case "POST":
+			h := hook{}
+			if err := json.NewDecoder(req.Body).Decode(&h); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			h.ID = f.nextID
+			f.nextID++
+			f.hooks[fullName] = append(hooks, h)
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(h)
+		default:
+			http.Error(w, "", http.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	id, _ := strconv.Atoi(rest[0])
+	i := -1
+	for j, h := range hooks {
+		if h.ID == id {
+			i = j
+		}
+	}
+	if i < 0 {
+		http.Error(w, `{"message":"Not Found"}`, http.StatusNotFound)
+		return
+	}
+
+	switch {
+	case len(rest) == 2 && (rest[1] == "test" || rest[1] == "pings") &&
+		req.Method == "POST":
+		w.WriteHeader(http.StatusNoContent)
+	case len(rest) == 1 && req.Method == "GET":
+		json.NewEncoder(w).Encode(hooks[i])
+	case len(rest) == 2 && rest[1] == "config" && req.Method == "PATCH":
+		conf := map[string]interface{}{}
+		if err := json.NewDecoder(req.Body).Decode(&conf); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		for k, v := range conf {
+			hooks[i].Config[k] = v
+		}
+		json.NewEncoder(w).Encode(hooks[i].Config)
+	case len(rest) == 1 && req.Method == "PATCH":
+		h := hooks[i]
+		if err := json.NewDecoder(req.Body).Decode(&h); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		h.ID = id
+		hooks[i] = h
+		json.NewEncoder(w).Encode(h)
+	case len(rest) == 1 && req.Method == "DELETE":
+		f.hooks[fullName] = append(hooks[:i:i], hooks[i+1:]...)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "", http.StatusMethodNotAllowed)
+	}
+}
+
+func TestListRepos(t *testing.T) {
+	defer func(o string) { *org = o }(*org)
+	*org = "couchbaselabs"
+
+	f := newFakeGithub(t, "", testRepo(1, "couchbaselabs/a"),
+		testRepo(2, "couchbaselabs/b"), testRepo(3, "couchbaselabs/c"))
+
+	var got []string
+	for r := range listRepos() {
+		got = append(got, r.FullName)
+	}
+	if strings.Join(got, " ") != "couchbaselabs/a couchbaselabs/b couchbaselabs/c" {
+		t.Errorf("listRepos() = %v", got)
+	}
+	if reqs := f.requests(); len(reqs) != 2 {
+		t.Errorf("Expected two pages, got requests %v", reqs)
+	}
+}
+
+func TestUpdateHooks(t *testing.T) {
+	defer func(d bool, e string) { *del, *events = d, e }(*del, *events)
+	*del, *events = false, "push"
+
+	r := testRepo(1, "dustin/gitmirror")
+	f := newFakeGithub(t, "http://example.com/gitmirror/{{.FullName}}.git", r)
+	f.addHook(r.FullName, hook{Name: "web", Events: []string{"push"},
+		Config: map[string]interface{}{"url": "http://example.com/other"}})
+
+	if res := updateHooks(r); res.Status != resultOK {
+		t.Errorf("First updateHooks = %+v", res)
+	}
+	hooks := f.hooksOf(r.FullName)
+	if len(hooks) != 2 ||
+		hooks[1].Config["url"] != "http://example.com/gitmirror/dustin/gitmirror.git" {
+		t.Fatalf("After setup, hooks = %+v", hooks)
+	}
+
+	// Already set up, so nothing to do.
+	n := len(f.requests())
+	if res := updateHooks(r); res.Status != resultSkipped {
+		t.Errorf("Second updateHooks = %+v", res)
+	}
+	if got := f.requests()[n:]; len(got) != 1 {
+		t.Errorf("Expected just a hook listing, got %v", got)
+	}
+
+	*del = true
+	updateHooks(r)
+	if hooks := f.hooksOf(r.FullName); len(hooks) != 1 ||
+		hooks[0].Config["url"] != "http://example.com/other" {
+		t.Errorf("After teardown, hooks = %+v", hooks)
+	}
+}
+
+func TestGetRepo(t *testing.T) {
+	defer func(u string, sl func(time.Duration)) {
+		*username, sleep = u, sl
+	}(*username, sleep)
+	sleep = func(time.Duration) {}
+	f := newFakeGithub(t, "")
+
+	tests := []struct {
+		user, name, want string
+		asks             bool
+	}{
+		{"", "gitmirror", fakeLogin + "/gitmirror", true},
+		{"dustin", "gitmirror", "dustin/gitmirror", false},
+		{"", "dustin/gitmirror", "dustin/gitmirror", false},
+	}
+	for _, test := range tests {
+		*username = test.user
+		n := len(f.requests())
+		r, err := getRepo(test.name)
+		if err != nil || r.FullName != test.want ||
+			r.Owner.Login+"/"+r.Name != test.want {
+			t.Errorf("getRepo(%q) with -user=%q = %+v, %v; want %v",
+				test.name, test.user, r, err, test.want)
+		}
+		if asked := len(f.requests()) > n; asked != test.asks {
+			t.Errorf("getRepo(%q) with -user=%q asked github: %v",
+				test.name, test.user, asked)
+		}
+	}
+
+	apiToken = "wrong"
+	*username = ""
+	if r, err := getRepo("gitmirror"); err == nil {
+		t.Errorf("getRepo with a bad token = %+v", r)
+	}
+}
+
+func TestAPIHost(t *testing.T) {
+	defer func(a string) { *api = a }(*api)
+
+	tests := map[string]string{
+		"https://api.github.com":         "github.com",
+		"https://ghe.example.com/api/v3": "ghe.example.com",
+		"http://localhost:8080/api/v3":   "localhost:8080",
+	}
+	for u, want := range tests {
+		*api = u
+		if got := apiHost(); got != want {
+			t.Errorf("apiHost() with -api=%v = %q; want %q", u, got, want)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/dustin/httputil"
+)
+
+// bootstrapping reports whether setuphooks is to create mirrors too.
+func bootstrapping() bool {
+	return *mirrorAPI != "" || *mirrorDir != ""
+}
+
+// mirrorPath is where r's mirror lives under gitmirror's -dir: its
+// rendered template, less -prefix.
+func mirrorPath(r repo) (string, error) {
+	u, err := mirrorFor(r)
+	if err != nil {
+		return "", err
+	}
+	prefix := *mirrorPrefix
+	if prefix == "" {
+		prefix = templatePrefix()
+	}
+	if !strings.HasPrefix(u, prefix) {
+		return "", fmt.Errorf("%q doesn't start with %q", u, prefix)
+	}
+	p := strings.Trim(strings.TrimPrefix(u, prefix), "/")
+	if c := path.Clean("/" + p)[1:]; c == "" || c != p {
+		return "", fmt.Errorf("bad mirror path %q", p)
+	}
+	return p, nil
+}
+
+// remoteFor is where r's mirror is cloned from.
+func remoteFor(r repo) string {
+	switch {
+	case *cloneProto == "ssh" && r.SSHURL != "":
+		return r.SSHURL
+	case *cloneProto == "ssh":
+		return fmt.Sprintf("git@%v:%v.git", strings.Split(apiHost(), ":")[0], r.FullName)
+	case r.CloneURL != "":
+		return r.CloneURL
+	}
+	return fmt.Sprintf("https://%v/%v.git", apiHost(), r.FullName)
+}
+
+// createMirror asks gitmirror (through its admin API) to create a
+// mirror of remote at p.  It reports whether there was one already.
+func createMirror(p, remote string) (bool, error) {
+	body, err := json.Marshal(map[string]string{"name": p, "url": remote})
+	if err != nil {
+		return false, err
+	}
+	req, err := http.NewRequest("POST",
+		strings.TrimSuffix(*mirrorAPI, "/")+"/_admin/mirrors",
+		bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Authorization", "Bearer "+*adminToken)
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer res.Body.Close()
+	switch res.StatusCode {
+	case http.StatusCreated:
+		return false, nil
+	case http.StatusConflict:
+		return true, nil
+	}
+	return false, httputil.HTTPError(res)
+}
+
+// cloneMirror clones remote straight into p under -mirrordir, the way
+// gitmirror would.
+func cloneMirror(p, remote string) (bool, error) {
+	dest := filepath.Join(*mirrorDir, filepath.FromSlash(p))
+	if _, err := os.Stat(dest); err == nil {
+		return true, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(dest), os.ModePerm); err != nil {
+		return false, err
+	}
+	out, err := exec.Command("git", "clone", "--mirror", "--bare",
+		"--", remote, dest).CombinedOutput()
+	if err != nil {
+		os.RemoveAll(dest)
+		return false, fmt.Errorf("git clone: %v: %s", err, bytes.TrimSpace(out))
+	}
+	return false, nil
+}
+
+// bootstrapRepo creates r's mirror, by -mirrorapi or in -mirrordir.
+func bootstrapRepo(r repo) result {
+	p, err := mirrorPath(r)
+	if err != nil {
+		return failed(r.FullName, err)
+	}
+	remote := remoteFor(r)
+	if *noop {
+		return result{r.FullName, resultSkipped, "would mirror to " + p}
+	}
+
+	create := createMirror
+	if *mirrorAPI == "" {
+		create = cloneMirror
+	}
+	exists, err := create(p, remote)
+	switch {
+	case err != nil:
+		return failed(r.FullName, fmt.Errorf("mirroring to %v: %v", p, err))
+	case exists:
+		return result{r.FullName, resultSkipped, "already mirrored"}
+	}
+	return result{r.FullName, resultOK, "mirrored to " + p}
+}
+
+// withMirror also bootstraps each repo's mirror after f's done its
+// hooks (unless that failed, or hooks are being deleted).
+func withMirror(f func(repo) result) func(repo) result {
+	if !bootstrapping() || *del {
+		return f
+	}
+	return func(r repo) result {
+		res := f(r)
+		if res.Status == resultFailed {
+			return res
+		}
+		m := bootstrapRepo(r)
+		if m.Status == resultSkipped {
+			m.Status = res.Status
+		}
+		m.Detail = res.Detail + "; " + m.Detail
+		return m
+	}
+}
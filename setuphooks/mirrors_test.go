@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestMirrorPath(t *testing.T) {
+	defer func(p string) { *mirrorPrefix = p }(*mirrorPrefix)
+
+	r := testRepo(1, "dustin/gitmirror")
+	tests := []struct {
+		tmpl, prefix, want string
+		err                bool
+	}{
+		{"http://example.com:8124/{{.FullName}}.git", "",
+			"dustin/gitmirror.git", false},
+		{"http://example.com/{{.Owner.Login}}/{{.Name}}", "http://example.com/",
+			"dustin/gitmirror", false},
+		{"http://example.com/m/{{.Name}}", "http://example.com/",
+			"m/gitmirror", false},
+		{"http://example.com/m/{{.Name}}", "http://other.com/", "", true},
+		{"http://example.com/{{.Name}}/../x", "", "", true},
+		{"http://example.com/m/", "http://example.com/m/", "", true},
+	}
+	for _, test := range tests {
+		newFakeGithub(t, test.tmpl)
+		*mirrorPrefix = test.prefix
+		got, err := mirrorPath(r)
+		if (err != nil) != test.err || got != test.want {
+			t.Errorf("mirrorPath with %q (prefix %q) = %q, %v; want %q",
+				test.tmpl, test.prefix, got, err, test.want)
+		}
+	}
+}
+
+func TestRemoteFor(t *testing.T) {
+	defer func(a, p string) { *api, *cloneProto = a, p }(*api, *cloneProto)
+	*api = "https://api.github.com"
+
+	bare := testRepo(1, "dustin/gitmirror")
+	full := bare
+	full.CloneURL = "https://github.com/dustin/gitmirror.git"
+	full.SSHURL = "git@github.com:dustin/gitmirror.git"
+
+	tests := []struct {
+		proto string
+		r     repo
+		want  string
+	}{
+		{"https", full, full.CloneURL},
+		{"ssh", full, full.SSHURL},
+		{"https", bare, "https://github.com/dustin/gitmirror.git"},
+		{"ssh", bare, "git@github.com:dustin/gitmirror.git"},
+	}
+	for _, test := range tests {
+		*cloneProto = test.proto
+		if got := remoteFor(test.r); got != test.want {
+			t.Errorf("remoteFor(%+v) over %v = %q; want %q",
+				test.r, test.proto, got, test.want)
+		}
+	}
+}
+
+// fakeGitmirror is gitmirror's admin API for creating mirrors.
+func fakeGitmirror(t *testing.T, created map[string]string) *httptest.Server {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "POST" || req.URL.Path != "/_admin/mirrors" {
+			http.Error(w, "Not found", http.StatusNotFound)
+			return
+		}
+		if req.Header.Get("Authorization") != "Bearer sekrit" {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		var body struct{ Name, URL string }
+		json.NewDecoder(req.Body).Decode(&body)
+		if _, exists := created[body.Name]; exists {
+			http.Error(w, "Mirror exists", http.StatusConflict)
+			return
+		}
+		created[body.Name] = body.URL
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("{}"))
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestBootstrapViaAPI(t *testing.T) {
+	defer func(a, tok, d string, n, dl bool, e string) {
+		*mirrorAPI, *adminToken, *mirrorDir, *noop, *del, *events = a, tok, d, n, dl, e
+	}(*mirrorAPI, *adminToken, *mirrorDir, *noop, *del, *events)
+
+	r := testRepo(1, "dustin/gitmirror")
+	r.CloneURL = "https://github.com/dustin/gitmirror.git"
+	f := newFakeGithub(t, "http://example.com/{{.FullName}}", r)
+
+	created := map[string]string{}
+	s := fakeGitmirror(t, created)
+	*mirrorAPI, *adminToken, *mirrorDir = s.URL+"/", "sekrit", ""
+	*noop, *del, *events = false, false, "push"
+
+	setupAndMirror := withMirror(updateHooks)
+	res := setupAndMirror(r)
+	if res.Status != resultOK || created["dustin/gitmirror"] != r.CloneURL {
+		t.Errorf("First run = %+v, created %v", res, created)
+	}
+	if len(f.hooksOf(r.FullName)) != 1 {
+		t.Errorf("Expected a hook, got %+v", f.hooksOf(r.FullName))
+	}
+
+	// Both already done.
+	if res := setupAndMirror(r); res.Status != resultSkipped {
+		t.Errorf("Second run = %+v", res)
+	}
+
+	*adminToken = "wrong"
+	if res := bootstrapRepo(r); res.Status != resultFailed {
+		t.Errorf("With the wrong token, got %+v", res)
+	}
+}
+
+func TestBootstrapClone(t *testing.T) {
+	defer func(a, d string, n bool) {
+		*mirrorAPI, *mirrorDir, *noop = a, d, n
+	}(*mirrorAPI, *mirrorDir, *noop)
+
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("no git")
+	}
+
+	tmp := t.TempDir()
+	src := filepath.Join(tmp, "src.git")
+	if out, err := exec.Command("git", "init", "--bare", src).CombinedOutput(); err != nil {
+		t.Fatalf("git init: %v: %s", err, out)
+	}
+
+	r := testRepo(1, "dustin/gitmirror")
+	r.CloneURL = src
+	newFakeGithub(t, "http://example.com/{{.FullName}}.git", r)
+	*mirrorAPI, *mirrorDir = "", filepath.Join(tmp, "mirrors")
+
+	*noop = true
+	if res := bootstrapRepo(r); res.Status != resultSkipped {
+		t.Errorf("With -n, got %+v", res)
+	}
+	dest := filepath.Join(*mirrorDir, "dustin", "gitmirror.git")
+	if _, err := os.Stat(dest); !os.IsNotExist(err) {
+		t.Fatalf("With -n, mirror made anyway: %v", err)
+	}
+
+	*noop = false
+	if res := bootstrapRepo(r); res.Status != resultOK {
+		t.Fatalf("Cloning, got %+v", res)
+	}
+	if _, err := os.Stat(filepath.Join(dest, "HEAD")); err != nil {
+		t.Errorf("No mirror cloned: %v", err)
+	}
+	if res := bootstrapRepo(r); res.Status != resultSkipped {
+		t.Errorf("Cloning again, got %+v", res)
+	}
+
+	r.CloneURL = filepath.Join(tmp, "missing.git")
+	r.FullName, r.Name = "dustin/missing", "missing"
+	if res := bootstrapRepo(r); res.Status != resultFailed {
+		t.Errorf("Cloning nothing, got %+v", res)
+	}
+	if _, err := os.Stat(filepath.Join(*mirrorDir, "dustin", "missing.git")); !os.IsNotExist(err) {
+		t.Errorf("Failed clone left behind: %v", err)
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+// orgHooks is the API path of -org's hooks.
+func orgHooks() string {
+	return "/orgs/" + *org + "/hooks"
+}
+
+// manageOrgHook sets up (or with -d, removes) the one hook -org needs
+// instead of one per repository.  The hook points at the template's
+// prefix, and gitmirror (run with the same -template) works out which
+// mirror each delivery is for.
+func manageOrgHook() {
+	name, path := "org "+*org, orgHooks()
+	want := wantHook(templatePrefix())
+
+	if *rotate {
+		report.add(rotateSecrets(name, path, want))
+		return
+	}
+
+	hooks := []hook{}
+	if _, err := getJSON(name, path, &hooks); err != nil {
+		report.add(failed(name, err))
+		return
+	}
+	if !*del {
+		plan := planHooks(name, path, want, hooks)
+		if len(plan) == 0 {
+			report.add(result{name, resultSkipped, "nothing to do"})
+		}
+		applyPlan(plan)
+		return
+	}
+
+	var plan []step
+	for _, h := range hooks {
+		if ownedHook(want, h) {
+			plan = append(plan, step{Name: name, Hooks: path,
+				Action: "delete", ID: h.ID})
+		}
+	}
+	if len(plan) == 0 {
+		report.add(result{name, resultSkipped, "no gitmirror hook"})
+	}
+	applyPlan(plan)
+}
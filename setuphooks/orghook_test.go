@@ -0,0 +1,41 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestManageOrgHook(t *testing.T) {
+	defer func(o, e string, d, n, tst bool) {
+		*org, *events, *del, *noop, *test = o, e, d, n, tst
+	}(*org, *events, *del, *noop, *test)
+	*org, *events, *del, *noop, *test = "myorg", "push,repository", false, false, true
+
+	f := newFakeGithub(t, "http://example.com/gitmirror/{{.FullName}}.git")
+	f.addHook("orgs/myorg", webHook("http://ci.example.com/", true, "push"))
+
+	manageOrgHook()
+	hooks := f.hooksOf("orgs/myorg")
+	if len(hooks) != 2 {
+		t.Fatalf("After setup, org hooks = %+v", hooks)
+	}
+	if why := drift(hooks[1], wantHook("http://example.com/gitmirror/")); len(why) > 0 {
+		t.Errorf("New org hook differs in %v: %+v", why, hooks[1])
+	}
+	if reqs := f.requests(); reqs[len(reqs)-1] != "POST /orgs/myorg/hooks/2/pings" {
+		t.Errorf("Expected new hook to be pinged, got %v", reqs)
+	}
+
+	// Running it again changes nothing.
+	n := len(f.requests())
+	manageOrgHook()
+	if reqs := f.requests()[n:]; len(reqs) != 1 {
+		t.Errorf("Expected just a hook listing, got %v", reqs)
+	}
+
+	*del = true
+	manageOrgHook()
+	if hooks := f.hooksOf("orgs/myorg"); len(hooks) != 1 ||
+		hooks[0].Config["url"] != "http://ci.example.com/" {
+		t.Errorf("After teardown, org hooks = %+v", hooks)
+	}
+}
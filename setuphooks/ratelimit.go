@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// How many times a request is put off for rate limiting before
+	// giving up on it.
+	maxRateWaits = 10
+	// How long to back off from a secondary rate limit that doesn't
+	// say, as github suggests.
+	secondaryBackoff = time.Minute
+)
+
+var (
+	// sleep is time.Sleep, except in tests.
+	sleep = time.Sleep
+	// How often forEach reports progress.
+	progressEvery = 10 * time.Second
+)
+
+// rateLimiter keeps track of github's rate limits, so all the workers
+// hold off together once they're hit.
+type rateLimiter struct {
+	mu        sync.Mutex
+	remaining int // -1 if unknown
+	reset     time.Time
+	pause     time.Time // held off until then by a Retry-After
+}
+
+var limits = &rateLimiter{remaining: -1}
+
+// until is when the next request can be made.
+func (l *rateLimiter) until() time.Time {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	t := l.pause
+	if l.remaining == 0 && l.reset.After(t) {
+		t = l.reset
+	}
+	return t
+}
+
+// wait holds off until the next request can be made.
+func (l *rateLimiter) wait() {
+	if d := time.Until(l.until()); d > 0 {
+		log.Printf("Rate limited, waiting %v", d.Round(time.Second))
+		sleep(d)
+	}
+}
+
+// update records the limits a response reports.
+func (l *rateLimiter) update(res *http.Response) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if n, err := strconv.Atoi(res.Header.Get("X-RateLimit-Remaining")); err == nil {
+		l.remaining = n
+	}
+	if n, err := strconv.ParseInt(res.Header.Get("X-RateLimit-Reset"), 10, 64); err == nil {
+		l.reset = time.Unix(n, 0)
+	}
+}
+
+// holdOff stops all requests for d.
+func (l *rateLimiter) holdOff(d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if t := time.Now().Add(d); t.After(l.pause) {
+		l.pause = t
+	}
+}
+
+// retryAfter returns how long to wait before retrying a request that
+// got res, if it was turned away by a rate limit.  Other 403s (i.e.
+// permission problems) aren't worth retrying.
+func retryAfter(res *http.Response, now time.Time) time.Duration {
+	if res.StatusCode != http.StatusForbidden &&
+		res.StatusCode != http.StatusTooManyRequests {
+		return 0
+	}
+	if n, err := strconv.Atoi(res.Header.Get("Retry-After")); err == nil {
+		return time.Duration(n) * time.Second
+	}
+	if res.Header.Get("X-RateLimit-Remaining") == "0" {
+		n, err := strconv.ParseInt(res.Header.Get("X-RateLimit-Reset"), 10, 64)
+		if d := time.Unix(n, 0).Sub(now); err == nil && d > 0 {
+			return d
+		}
+		return time.Second
+	}
+	if res.StatusCode == http.StatusTooManyRequests {
+		return secondaryBackoff
+	}
+
+	// A 403 from a secondary rate limit only says so in its body.
+	b, err := ioutil.ReadAll(io.LimitReader(res.Body, 1<<16))
+	res.Body.Close()
+	res.Body = ioutil.NopCloser(bytes.NewReader(b))
+	if err == nil && bytes.Contains(bytes.ToLower(b), []byte("rate limit")) {
+		return secondaryBackoff
+	}
+	return 0
+}
+
+// doAPI does an API request, waiting out (and retrying after) rate
+// limits.
+func doAPI(req *http.Request) (*http.Response, error) {
+	for i := 0; ; i++ {
+		// Start the body over, in case this isn't the first time
+		// this request has been sent.
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req.Body = body
+		}
+
+		limits.wait()
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		limits.update(res)
+
+		d := retryAfter(res, time.Now())
+		if d == 0 || i >= maxRateWaits {
+			return res, nil
+		}
+		res.Body.Close()
+		limits.holdOff(d)
+	}
+}
+
+// forEach runs f on every repo, -j at a time, logging progress now
+// and then.  Whatever f says happened is reported, unless it's
+// result{} (i.e. f reports it itself).
+func forEach(repos <-chan repo, f func(repo) result) {
+	var done int64
+	stop := make(chan bool)
+	go func() {
+		t := time.NewTicker(progressEvery)
+		defer t.Stop()
+		last := int64(0)
+		for {
+			select {
+			case <-stop:
+				return
+			case <-t.C:
+				if n := atomic.LoadInt64(&done); n != last {
+					log.Printf("Progress: %v repos done", n)
+					last = n
+				}
+			}
+		}
+	}()
+
+	n := *workers
+	if n < 1 {
+		n = 1
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for r := range repos {
+				if res := f(r); res != (result{}) {
+					report.add(res)
+				}
+				atomic.AddInt64(&done, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	close(stop)
+	log.Printf("Done with %v repos", done)
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func testResponse(status int, body string, headers ...string) *http.Response {
+	res := &http.Response{StatusCode: status, Header: http.Header{},
+		Body: ioutil.NopCloser(strings.NewReader(body))}
+	for i := 0; i < len(headers); i += 2 {
+		res.Header.Set(headers[i], headers[i+1])
+	}
+	return res
+}
+
+func TestRetryAfter(t *testing.T) {
+	now := time.Unix(1000000, 0)
+	tests := []struct {
+		res  *http.Response
+		want time.Duration
+	}{
+		{testResponse(200, "", "X-RateLimit-Remaining", "0"), 0},
+		{testResponse(404, ""), 0},
+		{testResponse(403, `{"message": "Must have admin rights"}`), 0},
+		{testResponse(403, "", "Retry-After", "30"), 30 * time.Second},
+		{testResponse(429, "", "Retry-After", "5"), 5 * time.Second},
+		{testResponse(403, "", "X-RateLimit-Remaining", "0",
+			"X-RateLimit-Reset", "1000120"), 2 * time.Minute},
+		{testResponse(403, `{"message": "You have exceeded a secondary rate limit"}`),
+			secondaryBackoff},
+		{testResponse(429, ""), secondaryBackoff},
+	}
+	for i, test := range tests {
+		if got := retryAfter(test.res, now); got != test.want {
+			t.Errorf("#%v: retryAfter = %v; want %v", i, got, test.want)
+		}
+	}
+
+	// The body's still there to report after peeking at it.
+	res := testResponse(403, "Must have admin rights")
+	retryAfter(res, now)
+	if b, _ := ioutil.ReadAll(res.Body); string(b) != "Must have admin rights" {
+		t.Errorf("Body after retryAfter = %q", b)
+	}
+}
+
+func TestDoAPIRateLimited(t *testing.T) {
+	defer func(s func(time.Duration), l *rateLimiter) { sleep, limits = s, l }(sleep, limits)
+	var slept []time.Duration
+	sleep = func(d time.Duration) { slept = append(slept, d) }
+	limits = &rateLimiter{remaining: -1}
+
+	var mu sync.Mutex
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		calls++
+		if b, _ := ioutil.ReadAll(req.Body); string(b) != "hi" {
+			t.Errorf("Call %v got body %q", calls, b)
+		}
+		if calls == 1 {
+			w.Header().Set("X-RateLimit-Remaining", "0")
+			w.Header().Set("X-RateLimit-Reset",
+				fmt.Sprint(time.Now().Add(time.Hour).Unix()))
+			http.Error(w, "API rate limit exceeded", http.StatusForbidden)
+			return
+		}
+		w.Header().Set("X-RateLimit-Remaining", "4999")
+	}))
+	defer srv.Close()
+
+	req, err := http.NewRequest("POST", srv.URL, bytes.NewReader([]byte("hi")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := doAPI(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != 200 || calls != 2 {
+		t.Errorf("Got %v after %v calls; want 200 after 2", res.Status, calls)
+	}
+	if len(slept) != 1 || slept[0] < 59*time.Minute {
+		t.Errorf("Slept %v; want about an hour", slept)
+	}
+	if limits.remaining != 4999 {
+		t.Errorf("Remaining = %v; want 4999", limits.remaining)
+	}
+}
+
+func TestForEach(t *testing.T) {
+	defer func(j int) { *workers = j }(*workers)
+	*workers = 3
+
+	ch := make(chan repo)
+	go func() {
+		defer close(ch)
+		for i := 0; i < 20; i++ {
+			ch <- testRepo(i, fmt.Sprintf("dustin/r%v", i))
+		}
+	}()
+
+	var mu sync.Mutex
+	running, most := 0, 0
+	seen := map[string]bool{}
+	forEach(ch, func(r repo) result {
+		mu.Lock()
+		running++
+		if running > most {
+			most = running
+		}
+		seen[r.FullName] = true
+		mu.Unlock()
+
+		time.Sleep(time.Millisecond)
+
+		mu.Lock()
+		running--
+		mu.Unlock()
+		return result{}
+	})
+
+	if len(seen) != 20 {
+		t.Errorf("Saw %v repos; want 20", len(seen))
+	}
+	if most > 3 {
+		t.Errorf("Ran %v at once; want at most 3", most)
+	}
+}
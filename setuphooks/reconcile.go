@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"text/template/parse"
+
+	"github.com/dustin/go-jsonpointer"
+)
+
+// gitmirror reads payloads from forms.
+const contentType = "form"
+
+// A step is one change reconciling makes to a repo's (or an org's)
+// hooks.
+type step struct {
+	Name   string // whose hooks
+	Hooks  string // API path of the hooks
+	Action string // create, update or delete
+	ID     int
+	Why    []string
+	Want   hook
+}
+
+func (s step) String() string {
+	return s.Action + " " + s.Name + s.details()
+}
+
+// change describes the step without saying whose hooks it's for.
+func (s step) change() string {
+	return s.Action + s.details()
+}
+
+func (s step) details() string {
+	rv := ""
+	if s.ID > 0 {
+		rv += fmt.Sprintf(" hook %v", s.ID)
+	}
+	if len(s.Why) > 0 {
+		rv += " (" + strings.Join(s.Why, ", ") + ")"
+	}
+	return rv
+}
+
+// wantHook is how gitmirror wants a hook to u set up.
+func wantHook(u string) hook {
+	h := hook{
+		Name:   "web",
+		Active: true,
+		Events: strings.Split(*events, ","),
+		Config: map[string]interface{}{
+			"url":          u,
+			"content_type": contentType,
+		},
+	}
+	if *secret != "" {
+		h.Config["secret"] = *secret
+	}
+	return h
+}
+
+// desiredHook is the hook gitmirror wants on r.
+func desiredHook(r repo) (hook, error) {
+	u, err := mirrorFor(r)
+	return wantHook(u), err
+}
+
+// templatePrefix is the part of the template before its first action.
+func templatePrefix() string {
+	if tmpl == nil || tmpl.Tree == nil || len(tmpl.Tree.Root.Nodes) == 0 {
+		return ""
+	}
+	if t, ok := tmpl.Tree.Root.Nodes[0].(*parse.TextNode); ok {
+		return string(t.Text)
+	}
+	return ""
+}
+
+// ownedPrefixes are the URL prefixes of hooks belonging to gitmirror:
+// -owned, or else templatePrefix.
+func ownedPrefixes() []string {
+	if *owned != "" {
+		return strings.Split(*owned, ",")
+	}
+	return []string{templatePrefix()}
+}
+
+// ownedHook reports whether h is one of gitmirror's hooks, given the
+// hook that's wanted.
+func ownedHook(want, h hook) bool {
+	if h.Name != "web" {
+		return false
+	}
+	u, _ := jsonpointer.Get(h.Config, "/url").(string)
+	if u == want.Config["url"] {
+		return true
+	}
+	for _, p := range ownedPrefixes() {
+		if p != "" && strings.HasPrefix(u, p) {
+			return true
+		}
+	}
+	return false
+}
+
+func sameEvents(a, b []string) bool {
+	return containsAll(a, b) && containsAll(b, a)
+}
+
+// drift lists what about h differs from want.  Github never shows
+// secrets, so all that can be seen is whether there is one, and that
+// only matters with -secret: without it, a hook's secret is none of
+// setuphooks' business.
+func drift(h, want hook) []string {
+	var rv []string
+	if jsonpointer.Get(h.Config, "/url") != want.Config["url"] {
+		rv = append(rv, "url")
+	}
+	if !sameEvents(h.Events, want.Events) {
+		rv = append(rv, "events")
+	}
+	if jsonpointer.Get(h.Config, "/content_type") != contentType {
+		rv = append(rv, "content_type")
+	}
+	if _, has := h.Config["secret"]; *secret != "" && !has {
+		rv = append(rv, "secret")
+	}
+	if !h.Active {
+		rv = append(rv, "active")
+	}
+	return rv
+}
+
+// planHooks works out the steps to take name's hooks (at API path
+// path) to the desired state: exactly one gitmirror hook, configured
+// like want.  The hook to keep is the one closest to that already.
+func planHooks(name, path string, want hook, hooks []hook) []step {
+	var mine []hook
+	for _, h := range hooks {
+		if ownedHook(want, h) {
+			mine = append(mine, h)
+		}
+	}
+	if len(mine) == 0 {
+		return []step{{Name: name, Hooks: path, Action: "create", Want: want}}
+	}
+
+	sort.SliceStable(mine, func(i, j int) bool {
+		di, dj := len(drift(mine[i], want)), len(drift(mine[j], want))
+		if di != dj {
+			return di < dj
+		}
+		return mine[i].ID < mine[j].ID
+	})
+
+	dups := mine[1:]
+	sort.Slice(dups, func(i, j int) bool { return dups[i].ID < dups[j].ID })
+
+	var rv []step
+	if why := drift(mine[0], want); len(why) > 0 {
+		rv = append(rv, step{name, path, "update", mine[0].ID, why, want})
+	}
+	for _, h := range dups {
+		rv = append(rv, step{name, path, "delete", h.ID,
+			[]string{"duplicate"}, want})
+	}
+	return rv
+}
+
+// patchConfig updates the given fields of hook id's config (of those
+// at API path hooks), leaving the rest as they are.
+func patchConfig(hooks string, id int, conf map[string]interface{}) error {
+	body, err := json.Marshal(conf)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("PATCH",
+		fmt.Sprintf("%v%v/%v/config", *api, hooks, id),
+		bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	authorize(req)
+	req.Header.Set("Content-Type", "application/json")
+	req.ContentLength = int64(len(body))
+
+	return retryableHTTP("update hook config", 200, req, nil)
+}
+
+// patchHook brings hook id of those at API path hooks into line with
+// h.  The config is patched on its own, field by field, since sending
+// the whole thing would drop a secret h doesn't have (i.e. one that's
+// there without -secret).
+func patchHook(hooks string, id int, h hook) error {
+	body, err := json.Marshal(map[string]interface{}{
+		"events": h.Events,
+		"active": h.Active,
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("PATCH",
+		fmt.Sprintf("%v%v/%v", *api, hooks, id),
+		bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	authorize(req)
+	req.Header.Set("Content-Type", "application/json")
+	req.ContentLength = int64(len(body))
+
+	if err := retryableHTTP("update hook", 200, req, nil); err != nil {
+		return err
+	}
+	return patchConfig(hooks, id, h.Config)
+}
+
+func (s step) apply() error {
+	switch s.Action {
+	case "create":
+		h, err := postHook(s.Hooks, s.Want)
+		if err == nil && *test {
+			err = h.testAt(s.Name, s.Hooks)
+		}
+		return err
+	case "update":
+		return patchHook(s.Hooks, s.ID, s.Want)
+	case "delete":
+		return deleteHook(s.Hooks, s.ID)
+	}
+	return fmt.Errorf("unknown action %q", s.Action)
+}
+
+// applyPlan prints plan, then (unless -n) carries it out.  Once a step
+// fails, the rest of the steps for the same hooks are skipped.
+func applyPlan(plan []step) {
+	if len(plan) == 0 {
+		log.Printf("Nothing to do")
+		return
+	}
+	fmt.Printf("Plan:\n")
+	for _, s := range plan {
+		fmt.Printf("  %v\n", s)
+	}
+
+	var names []string
+	changes := map[string][]string{}
+	errs := map[string]error{}
+	for _, s := range plan {
+		if _, seen := changes[s.Name]; !seen {
+			names = append(names, s.Name)
+		}
+		if errs[s.Name] != nil {
+			continue
+		}
+		changes[s.Name] = append(changes[s.Name], s.change())
+		if *noop {
+			continue
+		}
+		log.Printf("Applying %v", s)
+		if err := s.apply(); err != nil {
+			errs[s.Name] = fmt.Errorf("%v: %v", s.change(), err)
+		}
+	}
+
+	for _, n := range names {
+		switch {
+		case errs[n] != nil:
+			report.add(failed(n, errs[n]))
+		case *noop:
+			report.add(result{n, resultSkipped,
+				"would " + strings.Join(changes[n], "; ")})
+		default:
+			report.add(result{n, resultOK, strings.Join(changes[n], "; ")})
+		}
+	}
+}
+
+// reconcile plans the changes needed for every repo, prints the
+// plan, then (unless -n) carries it out.
+func reconcile(repos <-chan repo) {
+	var mu sync.Mutex
+	plans := map[string][]step{}
+	var names []string
+	forEach(repos, func(r repo) result {
+		want, err := desiredHook(r)
+		if err != nil {
+			return failed(r.FullName, err)
+		}
+		hooks := []hook{}
+		if _, err := getJSON(r.FullName, repoHooks(r), &hooks); err != nil {
+			return failed(r.FullName, err)
+		}
+		p := planHooks(r.FullName, repoHooks(r), want, hooks)
+		if len(p) == 0 {
+			return result{r.FullName, resultSkipped, "nothing to do"}
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		plans[r.FullName] = p
+		names = append(names, r.FullName)
+		// Reported once it's been applied.
+		return result{}
+	})
+
+	// Workers finish in any old order, but the plan should read the
+	// same every time.
+	sort.Strings(names)
+	var plan []step
+	for _, n := range names {
+		plan = append(plan, plans[n]...)
+	}
+	applyPlan(plan)
+}
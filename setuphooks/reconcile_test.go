@@ -0,0 +1,149 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func webHook(u string, active bool, events ...string) hook {
+	return hook{Name: "web", Active: active, Events: events,
+		Config: map[string]interface{}{"url": u, "content_type": contentType}}
+}
+
+func mustDesired(t *testing.T, r repo) hook {
+	h, err := desiredHook(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+func TestPlanHooks(t *testing.T) {
+	defer func(e, s string) { *events, *secret = e, s }(*events, *secret)
+	*events, *secret = "push", ""
+	newFakeGithub(t, "http://example.com/gitmirror/{{.FullName}}.git")
+
+	r := testRepo(1, "dustin/gitmirror")
+	want := "http://example.com/gitmirror/dustin/gitmirror.git"
+
+	withID := func(id int, h hook) hook { h.ID = id; return h }
+	formless := webHook(want, true, "push")
+	formless.Config = map[string]interface{}{"url": want}
+
+	tests := []struct {
+		name  string
+		hooks []hook
+		want  []string
+	}{
+		{"none", nil, []string{"create dustin/gitmirror"}},
+		{"others only", []hook{withID(1, webHook("http://ci.example.com/", true, "push"))},
+			[]string{"create dustin/gitmirror"}},
+		{"good", []hook{withID(1, webHook(want, true, "push"))}, nil},
+		{"moved", []hook{withID(3, webHook("http://example.com/gitmirror/old.git", true, "push"))},
+			[]string{"update dustin/gitmirror hook 3 (url)"}},
+		{"drifted", []hook{withID(4, webHook(want, false, "push", "issues"))},
+			[]string{"update dustin/gitmirror hook 4 (events, active)"}},
+		{"form", []hook{withID(5, formless)},
+			[]string{"update dustin/gitmirror hook 5 (content_type)"}},
+		{"duplicates", []hook{
+			withID(6, webHook("http://example.com/gitmirror/old.git", true, "push")),
+			withID(7, webHook("http://ci.example.com/", true, "push")),
+			withID(8, webHook(want, true, "push")),
+			withID(9, webHook(want, true, "push")),
+		}, []string{
+			"delete dustin/gitmirror hook 6 (duplicate)",
+			"delete dustin/gitmirror hook 9 (duplicate)",
+		}},
+	}
+
+	for _, test := range tests {
+		var got []string
+		for _, s := range planHooks(r.FullName, repoHooks(r), mustDesired(t, r), test.hooks) {
+			got = append(got, s.String())
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%v: plan = %q; want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestReconcile(t *testing.T) {
+	defer func(e, s string, n bool) { *events, *secret, *noop = e, s, n }(*events, *secret, *noop)
+	*events, *secret, *noop = "push", "", false
+
+	a, b := testRepo(1, "dustin/a"), testRepo(2, "dustin/b")
+	f := newFakeGithub(t, "http://example.com/gitmirror/{{.FullName}}.git", a, b)
+	f.addHook(a.FullName, webHook("http://example.com/gitmirror/a.git", false, "push"))
+	f.addHook(a.FullName, webHook("http://example.com/gitmirror/dustin/a.git", true))
+
+	ch := make(chan repo, 2)
+	ch <- a
+	ch <- b
+	close(ch)
+	reconcile(ch)
+
+	for _, r := range []repo{a, b} {
+		hooks := f.hooksOf(r.FullName)
+		if len(hooks) != 1 {
+			t.Errorf("%v has hooks %+v; want one", r.FullName, hooks)
+			continue
+		}
+		h := hooks[0]
+		if why := drift(h, mustDesired(t, r)); len(why) > 0 {
+			t.Errorf("%v's hook still differs in %v: %+v", r.FullName, why, h)
+		}
+	}
+	if reqs := strings.Join(f.requests(), "\n"); !strings.Contains(reqs, "PATCH /repos/dustin/a/hooks/2") {
+		t.Errorf("Expected hook 2 to be patched, got:\n%v", reqs)
+	}
+}
+
+func TestReconcileKeepsSecrets(t *testing.T) {
+	defer func(e, s string, n bool) { *events, *secret, *noop = e, s, n }(*events, *secret, *noop)
+	*events, *secret, *noop = "push", "", false
+
+	a, b := testRepo(1, "dustin/a"), testRepo(2, "dustin/b")
+	f := newFakeGithub(t, "http://example.com/gitmirror/{{.FullName}}.git", a, b)
+	// Github shows secrets masked.
+	withSecret := func(h hook) hook {
+		h.Config["secret"] = "********"
+		return h
+	}
+	f.addHook(a.FullName, withSecret(webHook("http://example.com/gitmirror/dustin/a.git", true, "push")))
+	f.addHook(b.FullName, withSecret(webHook("http://example.com/gitmirror/dustin/b.git", false, "push")))
+
+	reconcileAll := func() {
+		ch := make(chan repo, 2)
+		ch <- a
+		ch <- b
+		close(ch)
+		reconcile(ch)
+	}
+
+	// Without -secret, a secret isn't drift, and isn't removed when
+	// something else is fixed.
+	reconcileAll()
+	for _, r := range f.requests() {
+		if strings.Contains(r, "dustin/a") && !strings.HasPrefix(r, "GET") {
+			t.Errorf("dustin/a was fine, but got %v", r)
+		}
+	}
+	for _, r := range []repo{a, b} {
+		h := f.hooksOf(r.FullName)[0]
+		if h.Config["secret"] != "********" || !h.Active {
+			t.Errorf("%v's hook is now %+v", r.FullName, h)
+		}
+	}
+
+	// With -secret, one that's missing is added.
+	*secret = "sekrit"
+	h := f.hooksOf(a.FullName)[0]
+	if why := drift(h, mustDesired(t, a)); len(why) != 0 {
+		t.Errorf("With -secret, a hook with one drifted in %v", why)
+	}
+	delete(h.Config, "secret")
+	if why := drift(h, mustDesired(t, a)); !reflect.DeepEqual(why, []string{"secret"}) {
+		t.Errorf("With -secret, a hook without one drifted in %v", why)
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+)
+
+// What happened to a repo (or an org's hook).
+const (
+	resultOK      = "ok"
+	resultSkipped = "skipped"
+	resultFailed  = "failed"
+)
+
+type result struct {
+	Name   string
+	Status string
+	Detail string
+}
+
+func failed(name string, err error) result {
+	return result{name, resultFailed, err.Error()}
+}
+
+// results collects what happened to everything, for the summary at
+// the end of a run.
+type results struct {
+	mu   sync.Mutex
+	list []result
+}
+
+var report = &results{}
+
+func (rs *results) add(r result) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	rs.list = append(rs.list, r)
+}
+
+func (rs *results) count(status string) int {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	n := 0
+	for _, r := range rs.list {
+		if r.Status == status {
+			n++
+		}
+	}
+	return n
+}
+
+// print writes a table of results (sorted by name), then the totals.
+func (rs *results) print(w io.Writer) {
+	rs.mu.Lock()
+	list := append([]result(nil), rs.list...)
+	rs.mu.Unlock()
+	sort.SliceStable(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+
+	tw := tabwriter.NewWriter(w, 8, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "REPO\tRESULT\tDETAIL\n")
+	for _, r := range list {
+		// Errors (from github, especially) can run over lines.
+		detail := strings.Join(strings.Fields(r.Detail), " ")
+		fmt.Fprintf(tw, "%v\t%v\t%v\n", r.Name, r.Status, detail)
+	}
+	tw.Flush()
+	fmt.Fprintf(w, "\n%v succeeded, %v skipped, %v failed\n",
+		rs.count(resultOK), rs.count(resultSkipped), rs.count(resultFailed))
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFailuresDontStopTheRun(t *testing.T) {
+	defer func(s func(time.Duration), d bool, n bool) {
+		sleep, *del, *noop = s, d, n
+	}(sleep, *del, *noop)
+	sleep = func(time.Duration) {}
+	*del, *noop = false, false
+
+	a, b, c := testRepo(1, "dustin/a"), testRepo(2, "dustin/b"), testRepo(3, "dustin/c")
+	f := newFakeGithub(t, "http://example.com/gitmirror/{{.FullName}}.git", a, b, c)
+	f.broken[b.FullName] = true
+	f.addHook(c.FullName, webHook("http://example.com/gitmirror/dustin/c.git", true, "push"))
+
+	ch := make(chan repo, 3)
+	ch <- a
+	ch <- b
+	ch <- c
+	close(ch)
+	forEach(ch, updateHooks)
+
+	if len(f.hooksOf(a.FullName)) != 1 {
+		t.Errorf("dustin/a wasn't set up")
+	}
+	for status, want := range map[string]int{
+		resultOK: 1, resultSkipped: 1, resultFailed: 1} {
+		if got := report.count(status); got != want {
+			t.Errorf("%v %v; want %v", got, status, want)
+		}
+	}
+
+	out := &bytes.Buffer{}
+	report.print(out)
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	want := []string{
+		"REPO      RESULT   DETAIL",
+		"dustin/a  ok       setup",
+		"dustin/b  failed   dustin/b: error getting JSON from ",
+		"dustin/c  skipped  nothing to do",
+		"",
+		"1 succeeded, 1 skipped, 1 failed",
+	}
+	if len(lines) != len(want) {
+		t.Fatalf("Report:\n%v", out)
+	}
+	for i := range want {
+		if !strings.HasPrefix(lines[i], want[i]) {
+			t.Errorf("Report line %v = %q; want %q...", i, lines[i], want[i])
+		}
+	}
+}
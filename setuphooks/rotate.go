@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"log"
+)
+
+// setSecret changes just the secret of hook id of those at API path
+// hooks, leaving the rest of its config alone.
+func setSecret(hooks string, id int, s string) error {
+	return patchConfig(hooks, id, map[string]interface{}{"secret": s})
+}
+
+// rotateSecrets sets the secret of every gitmirror hook of name's (at
+// API path path, where want is the hook gitmirror wants) to -secret.
+// Other hooks are left alone.
+func rotateSecrets(name, path string, want hook) result {
+	hooks := []hook{}
+	if _, err := getJSON(name, path, &hooks); err != nil {
+		return failed(name, err)
+	}
+	n := 0
+	for _, h := range hooks {
+		if !ownedHook(want, h) {
+			continue
+		}
+		n++
+		log.Printf("Rotating secret of %v hook %v", name, h.ID)
+		if *noop {
+			continue
+		}
+		if err := setSecret(path, h.ID, *secret); err != nil {
+			return failed(name, fmt.Errorf("hook %v: %v", h.ID, err))
+		}
+	}
+
+	switch {
+	case n == 0:
+		return result{name, resultSkipped, "no gitmirror hook"}
+	case *noop:
+		return result{name, resultSkipped, fmt.Sprintf("would rotate %v", n)}
+	}
+	return result{name, resultOK, fmt.Sprintf("rotated %v", n)}
+}
+
+// rotateRepo rotates the secrets of r's gitmirror hooks.
+func rotateRepo(r repo) result {
+	want, err := desiredHook(r)
+	if err != nil {
+		return failed(r.FullName, err)
+	}
+	return rotateSecrets(r.FullName, repoHooks(r), want)
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestRotateSecrets(t *testing.T) {
+	defer func(s string, n bool) { *secret, *noop = s, n }(*secret, *noop)
+	*secret, *noop = "new", false
+
+	r := testRepo(1, "dustin/gitmirror")
+	f := newFakeGithub(t, "http://example.com/gitmirror/{{.FullName}}.git", r)
+	mine := webHook("http://example.com/gitmirror/dustin/gitmirror.git", true, "push")
+	mine.Config["secret"] = "old"
+	f.addHook(r.FullName, mine)
+	other := webHook("http://ci.example.com/", true, "push")
+	other.Config["secret"] = "ci"
+	f.addHook(r.FullName, other)
+
+	if res := rotateRepo(r); res.Status != resultOK {
+		t.Errorf("rotateRepo = %+v", res)
+	}
+
+	hooks := f.hooksOf(r.FullName)
+	if got := hooks[0].Config["secret"]; got != "new" {
+		t.Errorf("gitmirror hook's secret = %v; want new", got)
+	}
+	if got := hooks[0].Config["url"]; got != mine.Config["url"] {
+		t.Errorf("gitmirror hook's url changed to %v", got)
+	}
+	if got := hooks[1].Config["secret"]; got != "ci" {
+		t.Errorf("Other hook's secret = %v; want ci", got)
+	}
+}
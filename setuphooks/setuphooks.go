@@ -3,8 +3,10 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"os"
@@ -19,11 +21,14 @@ import (
 	"github.com/dustin/httputil"
 )
 
-const base = "https://api.github.com"
-
 var (
+	api = flag.String("api", "https://api.github.com",
+		"Github API URL (e.g. https://ghe.example.com/api/v3)")
+	token = flag.String("token", "",
+		"Github API token (default $GITHUB_TOKEN, else gh's login)")
 	username = flag.String("user", "", "Your github username")
-	password = flag.String("pass", "", "Your github password")
+	password = flag.String("pass", "",
+		"Your github enterprise password (github.com needs a token)")
 	org      = flag.String("org", "", "Organization to check")
 	noop     = flag.Bool("n", false, "If true, don't make any hook changes")
 	test     = flag.Bool("t", false, "Test hooks when creating them")
@@ -34,8 +39,46 @@ var (
 	verbose  = flag.Bool("v", false, "Print more stuff")
 	secret   = flag.String("secret", "",
 		"Optional secret to authenticate inbound hooks")
-
-	tmpl *template.Template
+	reconcileFlag = flag.Bool("reconcile", false,
+		"Fix drifted gitmirror hooks in place and remove duplicates")
+	rotate = flag.Bool("rotate", false,
+		"Change the secret of existing gitmirror hooks to -secret")
+	orgHook = flag.Bool("orghook", false,
+		"Manage one hook on -org (at the template's prefix) instead "+
+			"of one per repo")
+	includeFlag = flag.String("include", "",
+		"Comma separated name globs (or /regexps/) of repos to include")
+	excludeFlag = flag.String("exclude", "",
+		"Comma separated name globs (or /regexps/) of repos to exclude")
+	topicsFlag = flag.String("topic", "",
+		"Only repos with one of these comma separated topics")
+	languages = flag.String("language", "",
+		"Only repos in one of these comma separated languages")
+	visibility = flag.String("visibility", "all",
+		"Only public, private or all repos")
+	skipArchived    = flag.Bool("skiparchived", false, "Skip archived repos")
+	skipForks       = flag.Bool("skipforks", false, "Skip forks")
+	pushedSinceFlag = flag.String("pushedsince", "",
+		"Only repos pushed to since this date, or this long ago (e.g. 720h)")
+	workers   = flag.Int("j", 4, "How many repos to work on at once")
+	format    = flag.String("format", "json", "audit report format (json or csv)")
+	mirrorAPI = flag.String("mirrorapi", "",
+		"gitmirror to create mirrors through (e.g. http://localhost:8124/)")
+	adminToken = flag.String("admintoken", "",
+		"gitmirror's -admintoken (default $GITMIRROR_ADMIN_TOKEN)")
+	mirrorDir = flag.String("mirrordir", "",
+		"Clone mirrors straight into this directory (gitmirror's -dir)")
+	mirrorPrefix = flag.String("prefix", "",
+		"Stripped from the rendered template to get a mirror's path "+
+			"(default: the template up to its first {{)")
+	cloneProto = flag.String("cloneproto", "https",
+		"Create mirrors from https or ssh URLs")
+	owned = flag.String("owned", "",
+		"Comma separated URL prefixes of gitmirror hooks "+
+			"(default: the template up to its first {{)")
+
+	tmpl     *template.Template
+	apiToken string
 )
 
 type hook struct {
@@ -45,12 +88,22 @@ type hook struct {
 	Events []string               `json:"events,omitempty"`
 	Active bool                   `json:"active"`
 	Config map[string]interface{} `json:"config"`
+
+	LastResponse *lastResponse `json:"last_response,omitempty"`
+}
+
+// lastResponse is how the last delivery to a hook went.
+type lastResponse struct {
+	Code    *int   `json:"code"`
+	Status  string `json:"status"`
+	Message string `json:"message"`
 }
 
 func init() {
 	flag.Usage = func() {
-		fmt.Fprintf(os.Stderr, "Usage:\n%s [opts] template\n\nOptions:\n",
-			os.Args[0])
+		fmt.Fprintf(os.Stderr, "Usage:\n%s [opts] template\n"+
+			"%s audit [opts] template\n\nOptions:\n",
+			os.Args[0], os.Args[0])
 		flag.PrintDefaults()
 		tdoc := map[string]string{
 			"{{.ID}}":          "numeric ID of repo",
@@ -80,16 +133,16 @@ func init() {
 	}
 }
 
-func retryableHTTP(name string, st int, req *http.Request, jd interface{}) {
+func retryableHTTP(name string, st int, req *http.Request, jd interface{}) error {
 	var err error
 	for i := 0; i < 3; i++ {
 		if i > 0 {
 			log.Printf("Retrying %v to %v", req.Method, req.URL)
-			time.Sleep(time.Second * time.Duration(i))
+			sleep(time.Second * time.Duration(i))
 		}
 
 		var res *http.Response
-		res, err = http.DefaultClient.Do(req)
+		res, err = doAPI(req)
 		if err != nil {
 			continue
 		}
@@ -102,24 +155,36 @@ func retryableHTTP(name string, st int, req *http.Request, jd interface{}) {
 					continue
 				}
 			}
-			return
+			return nil
 		}
 		err = httputil.HTTPError(res)
 	}
-	log.Fatalf("Couldn't do %v against %s: %v", req.Method, req.URL, err)
+	return fmt.Errorf("%v: %v %s: %v", name, req.Method, req.URL, err)
 }
 
-func (h hook) Test(r repo) {
-	log.Printf("Testing %v -> %v", r.FullName,
+func (h hook) Test(r repo) error {
+	return h.testAt(r.FullName, repoHooks(r))
+}
+
+// testAt asks github to deliver something to h, one of the hooks at
+// API path hooks: a test push for a repository hook, or a ping for an
+// organization's.
+func (h hook) testAt(name, hooks string) error {
+	log.Printf("Testing %v -> %v", name,
 		jsonpointer.Get(h.Config, "/url"))
-	u := base + "/repos/" + r.FullName + "/hooks/" +
-		strconv.Itoa(h.ID) + "/test"
+	kind := "test"
+	if strings.HasPrefix(hooks, "/orgs/") {
+		kind = "pings"
+	}
+	u := *api + hooks + "/" + strconv.Itoa(h.ID) + "/" + kind
 
 	req, err := http.NewRequest("POST", u, nil)
-	maybeFatal("hook test", err)
+	if err != nil {
+		return err
+	}
 
-	req.SetBasicAuth(*username, *password)
-	retryableHTTP("hook test", 204, req, nil)
+	authorize(req)
+	return retryableHTTP("hook test", 204, req, nil)
 }
 
 type repo struct {
@@ -131,6 +196,14 @@ type repo struct {
 	Name     string
 	FullName string `json:"full_name"`
 	Language *string
+	CloneURL string `json:"clone_url"`
+	SSHURL   string `json:"ssh_url"`
+
+	Private  bool
+	Archived bool
+	Fork     bool
+	Topics   []string
+	PushedAt time.Time `json:"pushed_at"`
 }
 
 func maybeFatal(m string, err error) {
@@ -158,23 +231,26 @@ func parseLink(s string) map[string]string {
 }
 
 // Parses json stuff into a thing.  Returns the next URL if any
-func getJSON(name, subu string, out interface{}) string {
+func getJSON(name, subu string, out interface{}) (string, error) {
 	u := subu
 	if !strings.HasPrefix(u, "http") {
-		u = base + subu
+		u = *api + subu
 	}
 
 	req, err := http.NewRequest("GET", u, nil)
-	maybeFatal(name, err)
+	if err != nil {
+		return "", err
+	}
 
-	req.SetBasicAuth(*username, *password)
+	authorize(req)
 	for i := 0; i < 3; i++ {
 		if i > 0 {
 			log.Printf("Retrying JSON req to %v", req.URL)
+			sleep(time.Second * time.Duration(i))
 		}
 
 		var res *http.Response
-		res, err = http.DefaultClient.Do(req)
+		res, err = doAPI(req)
 		if err != nil {
 			continue
 		}
@@ -188,14 +264,17 @@ func getJSON(name, subu string, out interface{}) string {
 
 		d := json.NewDecoder(res.Body)
 
-		maybeFatal(name, d.Decode(out))
+		if err := d.Decode(out); err != nil {
+			return "", fmt.Errorf("%v: %v", name, err)
+		}
 
-		return links["next"]
+		return links["next"], nil
 	}
-	log.Fatalf("Error getting JSON from %v: %v", u, err)
-	panic("unreachable")
+	return "", fmt.Errorf("%v: error getting JSON from %v: %v", name, u, err)
 }
 
+// listRepos lists repos until it's listed them all, or can't list any
+// more (which is reported as a failure).
 func listRepos() chan repo {
 	rv := make(chan repo)
 
@@ -209,7 +288,12 @@ func listRepos() chan repo {
 		for next != "" {
 			repos := []repo{}
 			log.Printf("Fetching repos from %v", next)
-			next = getJSON("repo list", next, &repos)
+			var err error
+			next, err = getJSON("repo list", next, &repos)
+			if err != nil {
+				report.add(failed("(repo list)", err))
+				return
+			}
 
 			for _, r := range repos {
 				rv <- r
@@ -219,10 +303,12 @@ func listRepos() chan repo {
 	return rv
 }
 
-func mirrorFor(r repo) string {
+func mirrorFor(r repo) (string, error) {
 	b := bytes.Buffer{}
-	maybeFatal("executing template", tmpl.Execute(&b, r))
-	return b.String()
+	if err := tmpl.Execute(&b, r); err != nil {
+		return "", fmt.Errorf("executing template: %v", err)
+	}
+	return b.String(), nil
 }
 
 func contains(haystack []string, needle string) bool {
@@ -243,128 +329,205 @@ func containsAll(haystack, needles []string) bool {
 	return true
 }
 
-func mirrorID(r repo, hooks []hook) int {
-	u := mirrorFor(r)
+func mirrorID(r repo, hooks []hook) (int, error) {
+	u, err := mirrorFor(r)
+	if err != nil {
+		return -1, err
+	}
 	for _, h := range hooks {
 		if h.Name == "web" && jsonpointer.Get(h.Config, "/url") == u &&
 			(*events == "" ||
 				containsAll(h.Events, strings.Split(*events, ","))) {
 			if *testAll {
-				h.Test(r)
+				if err := h.Test(r); err != nil {
+					return h.ID, err
+				}
 			}
-			return h.ID
+			return h.ID, nil
 		}
 	}
-	return -1
+	return -1, nil
 }
 
-func createHook(r repo) hook {
-	h := hook{
-		Name:   "web",
-		Active: true,
-		Events: strings.Split(*events, ","),
-		Config: map[string]interface{}{"url": mirrorFor(r)},
-	}
-	if *secret != "" {
-		h.Config["secret"] = *secret
-	}
+// repoHooks is the API path of r's hooks.
+func repoHooks(r repo) string {
+	return "/repos/" + r.FullName + "/hooks"
+}
+
+// postHook adds h to the hooks at API path hooks.
+func postHook(hooks string, h hook) (hook, error) {
+	rv := hook{}
 	body, err := json.Marshal(&h)
-	maybeFatal("encoding", err)
+	if err != nil {
+		return rv, err
+	}
 
-	req, err := http.NewRequest("POST",
-		base+"/repos/"+r.FullName+"/hooks",
+	req, err := http.NewRequest("POST", *api+hooks,
 		bytes.NewReader(body))
-	maybeFatal("creating hook", err)
+	if err != nil {
+		return rv, err
+	}
 
-	req.SetBasicAuth(*username, *password)
+	authorize(req)
 	req.Header.Set("Content-Type", "application/json")
 	req.ContentLength = int64(len(body))
 
-	rv := hook{}
-	retryableHTTP("create hook", 201, req, &rv)
-
-	return rv
+	err = retryableHTTP("create hook", 201, req, &rv)
+	return rv, err
 }
 
-func teardown(id int, r repo) {
+// deleteHook deletes hook id from the hooks at API path hooks.
+func deleteHook(hooks string, id int) error {
 	req, err := http.NewRequest("DELETE",
-		fmt.Sprintf("%v/repos/%v/hooks/%v",
-			base, r.FullName, id),
-		nil)
-	maybeFatal("deleting hook", err)
+		fmt.Sprintf("%v%v/%v", *api, hooks, id), nil)
+	if err != nil {
+		return err
+	}
+
+	authorize(req)
+	return retryableHTTP("delete hook", 204, req, nil)
+}
+
+func createHook(r repo) (hook, error) {
+	want, err := desiredHook(r)
+	if err != nil {
+		return hook{}, err
+	}
+	return postHook(repoHooks(r), want)
+}
 
-	req.SetBasicAuth(*username, *password)
-	retryableHTTP("create hook", 204, req, nil)
+func teardown(id int, r repo) error {
+	return deleteHook(repoHooks(r), id)
 }
 
-func setup(id int, r repo) {
-	h := createHook(r)
-	if *test {
-		h.Test(r)
+func setup(id int, r repo) error {
+	h, err := createHook(r)
+	if err == nil && *test {
+		err = h.Test(r)
 	}
+	return err
 }
 
-func updateHooks(r repo) {
+func updateHooks(r repo) result {
 	hooks := []hook{}
-	getJSON(r.FullName, "/repos/"+r.FullName+"/hooks", &hooks)
-	actions := map[string]func(int, repo){
+	if _, err := getJSON(r.FullName, repoHooks(r), &hooks); err != nil {
+		return failed(r.FullName, err)
+	}
+	actions := map[string]func(int, repo) error{
 		"setup":    setup,
 		"teardown": teardown,
 	}
 
 	if *verbose {
-		fmt.Printf("Hooks for %v:\n", r.FullName)
+		// All at once, so other workers' output doesn't get mixed in.
+		b := &bytes.Buffer{}
+		fmt.Fprintf(b, "Hooks for %v:\n", r.FullName)
 		for _, h := range hooks {
 			conf := ""
 			for k, v := range h.Config {
 				conf += fmt.Sprintf("\n\t%v = %v", k, v)
 			}
-			fmt.Printf("%v: %v active=%v -%v\n\n",
+			fmt.Fprintf(b, "%v: %v active=%v -%v\n\n",
 				h.Name, h.Events, h.Active, conf)
 		}
+		os.Stdout.Write(b.Bytes())
 	}
 
 	action := "setup"
 
-	id := mirrorID(r, hooks)
+	id, err := mirrorID(r, hooks)
+	if err != nil {
+		return failed(r.FullName, err)
+	}
 	switch {
 	case id >= 0 && *del:
 		action = "teardown"
 	case id == -1 && !*del:
 		action = "setup"
 	default:
-		return
+		return result{r.FullName, resultSkipped, "nothing to do"}
 	}
 
 	log.Printf("Updating %v (%v)", r.FullName, action)
-	if !*noop {
-		actions[action](id, r)
+	if *noop {
+		return result{r.FullName, resultSkipped, "would " + action}
+	}
+	if err := actions[action](id, r); err != nil {
+		return failed(r.FullName, err)
 	}
+	return result{r.FullName, resultOK, action}
 }
 
-func getRepo(name string) repo {
+// login is whose repos -repo names without an owner are: -user, or
+// else whoever the token belongs to.
+func login() (string, error) {
+	if *username != "" {
+		return *username, nil
+	}
+	u := struct{ Login string }{}
+	if _, err := getJSON("(user)", "/user", &u); err != nil {
+		return "", err
+	}
+	if u.Login == "" {
+		return "", errors.New("can't tell who you are; try -user or owner/name")
+	}
+	return u.Login, nil
+}
+
+func getRepo(name string) (repo, error) {
 	rv := repo{}
 	parts := strings.Split(name, "/")
 	if len(parts) == 1 {
-		rv.FullName = *username + "/" + parts[0]
-		rv.Name = parts[0]
-		rv.Owner.Login = *username
-	} else {
-		rv.FullName = parts[0] + "/" + parts[1]
-		rv.Name = parts[1]
-		rv.Owner.Login = parts[0]
+		owner, err := login()
+		if err != nil {
+			return rv, err
+		}
+		parts = []string{owner, parts[0]}
+	}
+	rv.FullName = parts[0] + "/" + parts[1]
+	rv.Name = parts[1]
+	rv.Owner.Login = parts[0]
+	return rv, nil
+}
+
+// finish prints (to w) what happened to everything, and exits
+// non-zero if anything failed.
+func finish(w io.Writer) {
+	report.print(w)
+	if report.count(resultFailed) > 0 {
+		os.Exit(1)
 	}
-	return rv
 }
 
 func main() {
 	log.SetFlags(0)
-	flag.Parse()
+	args := os.Args[1:]
+	auditing := len(args) > 0 && args[0] == "audit"
+	if auditing {
+		args = args[1:]
+	}
+	flag.CommandLine.Parse(args)
+
+	// Not the flags' defaults, so -h doesn't show them.
+	if *token == "" {
+		*token = os.Getenv("GITHUB_TOKEN")
+	}
+	if *adminToken == "" {
+		*adminToken = os.Getenv("GITMIRROR_ADMIN_TOKEN")
+	}
+
+	*api = strings.TrimSuffix(*api, "/")
+	if *password == "" || *token != "" {
+		apiToken = findToken(apiHost())
+		if apiToken == "" {
+			log.Printf("No token found, try -token or gh auth login")
+		}
+	}
 
 	var tmplText = ""
 	if flag.NArg() > 0 {
 		tmplText = flag.Arg(0)
-	} else {
+	} else if !auditing {
 		log.Printf("No template given, just listing")
 		*noop = true
 		*verbose = true
@@ -374,11 +537,71 @@ func main() {
 	maybeFatal("parsing template", err)
 	tmpl = t
 
-	if *repoFlag == "" {
-		for r := range listRepos() {
-			updateHooks(r)
+	maybeFatal("parsing filters", setupFilters())
+
+	if bootstrapping() {
+		switch {
+		case tmplText == "":
+			log.Fatalf("creating mirrors needs a template")
+		case *mirrorAPI != "" && *mirrorDir != "":
+			log.Fatalf("-mirrorapi and -mirrordir can't be used together")
+		case *cloneProto != "https" && *cloneProto != "ssh":
+			log.Fatalf("-cloneproto must be https or ssh")
+		case auditing || *rotate || *reconcileFlag:
+			log.Fatalf("mirrors are only created while setting up hooks")
+		}
+	}
+
+	if *orgHook {
+		if *org == "" || templatePrefix() == "" {
+			log.Fatalf("-orghook needs -org and a template")
 		}
+		if auditing {
+			maybeFatal("auditing", auditOrg(*format, os.Stdout))
+			finish(os.Stderr)
+			return
+		}
+		manageOrgHook()
+		if bootstrapping() && !*del && !*rotate {
+			forEach(filterRepos(listRepos()), bootstrapRepo)
+		}
+		finish(os.Stdout)
+		return
+	}
+
+	var repos <-chan repo
+	if *repoFlag == "" {
+		repos = filterRepos(listRepos())
 	} else {
-		updateHooks(getRepo(*repoFlag))
+		ch := make(chan repo, 1)
+		r, err := getRepo(*repoFlag)
+		maybeFatal("finding "+*repoFlag, err)
+		ch <- r
+		close(ch)
+		repos = ch
+	}
+
+	switch {
+	case auditing:
+		if tmplText == "" {
+			log.Fatalf("audit needs a template to check hooks against")
+		}
+		maybeFatal("auditing", audit(repos, *format, os.Stdout))
+		// The report's what goes to stdout.
+		finish(os.Stderr)
+		return
+	case *rotate:
+		if *secret == "" || tmplText == "" {
+			log.Fatalf("-rotate needs a template and the new -secret")
+		}
+		forEach(repos, rotateRepo)
+	case *reconcileFlag:
+		if *del || tmplText == "" {
+			log.Fatalf("-reconcile needs a template, and can't be used with -d")
+		}
+		reconcile(repos)
+	default:
+		forEach(repos, withMirror(updateHooks))
 	}
+	finish(os.Stdout)
 }
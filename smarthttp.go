@@ -0,0 +1,69 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"net/http/cgi"
+	"path/filepath"
+	"strings"
+)
+
+// isPush reports whether a smart HTTP request is (part of) a push.
+func isPush(req *http.Request) bool {
+	return req.URL.Query().Get("service") == "git-receive-pack" ||
+		strings.HasSuffix(req.URL.Path, "/git-receive-pack")
+}
+
+// gitAuthorized checks a smart HTTP request against -gitauth.
+func gitAuthorized(req *http.Request) bool {
+	if *gitAuth == "" {
+		return true
+	}
+	u, p, ok := req.BasicAuth()
+	got := []byte(u + ":" + p)
+	return ok && subtle.ConstantTimeCompare(got, []byte(*gitAuth)) == 1
+}
+
+// handleGitHTTP serves the mirrors read-only over git's smart HTTP
+// protocol using git http-backend.
+func handleGitHTTP(w http.ResponseWriter, req *http.Request) {
+	if !gitAuthorized(req) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="gitmirror"`)
+		http.Error(w, "not authorized", http.StatusUnauthorized)
+		return
+	}
+	if isPush(req) {
+		http.Error(w, "mirrors are read only", http.StatusForbidden)
+		return
+	}
+
+	// A clone or fetch starts by asking for the refs.
+	if *maxAge > 0 && req.URL.Query().Get("service") == "git-upload-pack" &&
+		strings.HasSuffix(req.URL.Path, "/info/refs") {
+		p := strings.TrimPrefix(req.URL.Path, *gitPrefix)
+		p = strings.TrimSuffix(p, "/info/refs")
+		if abspath := filepath.Join(*thePath, filepath.Clean("/"+p)); exists(abspath) {
+			ensureFresh(abspath, *maxAge)
+		}
+	}
+
+	env := []string{
+		"GIT_PROJECT_ROOT=" + *thePath,
+		// http-backend allows pushes by authenticated users unless
+		// told otherwise.
+		"GIT_CONFIG_COUNT=1",
+		"GIT_CONFIG_KEY_0=http.receivepack",
+		"GIT_CONFIG_VALUE_0=false",
+	}
+	if *gitExportAll {
+		env = append(env, "GIT_HTTP_EXPORT_ALL=1")
+	}
+
+	h := &cgi.Handler{
+		Path: *git,
+		Args: []string{"http-backend"},
+		Root: strings.TrimSuffix(*gitPrefix, "/"),
+		Env:  env,
+	}
+	h.ServeHTTP(w, req)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestGitHTTP(t *testing.T) {
+	defer func(p, prefix, auth string, all bool) {
+		*thePath, *gitPrefix, *gitAuth, *gitExportAll = p, prefix, auth, all
+	}(*thePath, *gitPrefix, *gitAuth, *gitExportAll)
+
+	*thePath = t.TempDir()
+	*gitPrefix = "/git/"
+	*gitAuth = "u:p"
+	*gitExportAll = true
+
+	if out, err := exec.Command(*git, "init", "-q", "--bare",
+		filepath.Join(*thePath, "r.git")).CombinedOutput(); err != nil {
+		t.Fatalf("git init: %v\n%s", err, out)
+	}
+
+	tests := []struct {
+		path    string
+		auth    bool
+		status  int
+		content string
+	}{
+		{"/git/r.git/info/refs?service=git-upload-pack", false,
+			http.StatusUnauthorized, ""},
+		{"/git/r.git/info/refs?service=git-upload-pack", true,
+			http.StatusOK, "application/x-git-upload-pack-advertisement"},
+		{"/git/r.git/info/refs?service=git-receive-pack", true,
+			http.StatusForbidden, ""},
+		{"/git/nope.git/info/refs?service=git-upload-pack", true,
+			http.StatusNotFound, ""},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", test.path, nil)
+		if test.auth {
+			req.SetBasicAuth("u", "p")
+		}
+		w := httptest.NewRecorder()
+		handleGitHTTP(w, req)
+
+		if w.Code != test.status {
+			t.Errorf("%v (auth=%v): got %v; want %v\n%s",
+				test.path, test.auth, w.Code, test.status, w.Body)
+		}
+		ct := w.Header().Get("Content-Type")
+		if test.content != "" && !strings.HasPrefix(ct, test.content) {
+			t.Errorf("%v: content type %q; want %q", test.path, ct, test.content)
+		}
+	}
+}